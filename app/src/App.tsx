@@ -1,19 +1,72 @@
 import React, { useState, useEffect, useRef } from 'react';
 import './App.css';
-import { useTextStream } from "./text";
+import { useTextStream, Word, DebatePhase } from "./text";
 import AudioRecorder from './audio';
 
 interface AppProps {
   socket: WebSocket;
 }
 
+// Words the STT engine was less sure of than this get highlighted
+const LOW_CONFIDENCE = 0.6;
+
+// Shows a spoken message word by word, marking the ones that may have been misheard
+// and who is talking whenever the speaker changes
+const SpokenText: React.FC<{ words: Word[] }> = ({ words }) => (
+  <>
+    {words.map((word, index) => (
+      <span
+        key={index}
+        className={word.confidence < LOW_CONFIDENCE ? 'low-confidence' : undefined}
+        title={`${Math.round(word.confidence * 100)}% confident, ${word.start.toFixed(2)}s`}
+      >
+        {index > 0 && ' '}
+        {word.speaker !== undefined && word.speaker !== words[index - 1]?.speaker && (
+          <b className="speaker">Speaker {word.speaker}: </b>
+        )}
+        {word.word}
+      </span>
+    ))}
+  </>
+);
+
+const PHASE_NAMES: Record<string, string> = {
+  opening: 'Opening statements',
+  rebuttal: 'Rebuttal',
+  cross_examination: 'Cross-examination',
+  closing: 'Closing statements',
+};
+
+// Shows what's being debated, who argues what and how long the current phase has left
+const DebateBanner: React.FC<{ debate: DebatePhase }> = ({ debate }) => {
+  const [now, setNow] = useState(Date.now());
+  useEffect(() => {
+    const timer = setInterval(() => setNow(Date.now()), 1000);
+    return () => clearInterval(timer);
+  }, []);
+  const seconds = Math.max(0, Math.round((debate.endsAt - now) / 1000));
+  return (
+    <div className="debate">
+      <p>
+        <b>{debate.resolution}</b>: you argue {debate.userSide}, the bot argues {debate.userSide === 'for' ? 'against' : 'for'}
+      </p>
+      <p>
+        {debate.phase
+          ? `${PHASE_NAMES[debate.phase] ?? debate.phase}, ${Math.floor(seconds / 60)}:${String(seconds % 60).padStart(2, '0')} left`
+          : 'The debate is over'}
+      </p>
+    </div>
+  );
+};
+
 const App: React.FC<AppProps> = ({ socket }) => {
   const [conversationId, setConversationId] = useState<string>('');
   const [status, setStatus] = useState<string>('Press and hold Space Bar to record');
+  const [handsFree, setHandsFree] = useState<boolean>(false);
   const messagesEndRef = useRef<HTMLDivElement>(null);
   const audioElement = useRef<HTMLAudioElement | null>(null);
 
-  const { input, setInput, messages, currentBotMessage, currentUserMessage, handleSubmit } = useTextStream({
+  const { input, setInput, messages, currentBotMessage, currentUserMessage, handleSubmit, interrupt, error, debate } = useTextStream({
     socket,
     conversationId,
     audioElement,
@@ -23,6 +76,25 @@ const App: React.FC<AppProps> = ({ socket }) => {
     setConversationId('abc' + Math.round(Math.random() * 100));
   }, []);
 
+  // Set the conversation up from the URL: bind it to a persona, e.g. ?persona=tutor,
+  // and start a debate, e.g. ?debate=Cats%20are%20better%20than%20dogs&side=for
+  useEffect(() => {
+    const params = new URLSearchParams(window.location.search);
+    const persona = params.get('persona') ?? undefined;
+    const resolution = params.get('debate');
+    const debateOptions = resolution ? { resolution, side: params.get('side') ?? 'for' } : undefined;
+    if (!conversationId || (!persona && !debateOptions)) {
+      return;
+    }
+    const start = () => socket.send(JSON.stringify({ v: 1, type: 'session.start', conversationId, persona, debate: debateOptions }));
+    if (socket.readyState === WebSocket.OPEN) {
+      start();
+    } else {
+      socket.addEventListener('open', start, { once: true });
+      return () => socket.removeEventListener('open', start);
+    }
+  }, [socket, conversationId]);
+
   useEffect(() => {
     // Smooth scrolling
     messagesEndRef.current?.scrollIntoView({ behavior: 'smooth' });
@@ -32,15 +104,21 @@ const App: React.FC<AppProps> = ({ socket }) => {
     <div className="chat-app">
       <h1>Gordy's Text & Audio Streaming Chat UI</h1>
       <p>Conversation ID: {conversationId}</p>
+      {debate && <DebateBanner debate={debate} />}
       <p> This is a demo UI showing how an LLM can stream audio and text at the same time to a user. It is built using React and Go, leverages websockets for connection, Deepgram for STT and TTS, and Groq Llama 3.1 8B as the llm.</p>
       <div className="chat-messages">
         {messages.map((message, index) => (
           <div key={index} className={`message ${message.isUser ? 'user' : 'bot'}`}>
-            {message.text}
+            {message.words?.length ? <SpokenText words={message.words} /> : message.text}
+            {message.audioUrl && (
+              <button className="replay" title="Play this answer again" onClick={() => new Audio(message.audioUrl).play()}>
+                ▶
+              </button>
+            )}
           </div>
         ))}
         {currentUserMessage && (
-          <div className='message user'>
+          <div className='message user interim'>
             {currentUserMessage}
           </div>
         )}
@@ -66,9 +144,18 @@ const App: React.FC<AppProps> = ({ socket }) => {
         <button type="submit">Send</button>
       </form>
       <audio ref={audioElement} />
-      <AudioRecorder onUpdateStatus={setStatus}
-        conversationId={conversationId} socket={socket} />
+      <label>
+        <input
+          type="checkbox"
+          checked={handsFree}
+          onChange={(e) => setHandsFree(e.target.checked)}
+        />
+        Hands-free
+      </label>
+      <AudioRecorder onUpdateStatus={setStatus} onInterrupt={interrupt}
+        conversationId={conversationId} socket={socket} handsFree={handsFree} />
       <p>{status}</p>
+      {error && <p className="error">{error}</p>}
     </div>
   );
 };
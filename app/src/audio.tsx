@@ -4,13 +4,19 @@ interface AudioProps {
   socket: WebSocket;
   conversationId: string;
   onUpdateStatus: (status: string) => void;
+  onInterrupt: () => void;
+  handsFree: boolean;
 }
 
 const AudioRecorder: React.FC<AudioProps> = ({ socket, conversationId,
-  onUpdateStatus }) => {
+  onUpdateStatus, onInterrupt, handsFree }) => {
   const [audioRecorder, setAudioRecorder] = useState<MediaRecorder |
     null>(null);
   const [recording, setRecording] = useState<boolean>(false);
+  const stoppingHandsFree = useRef<boolean>(false);
+  // The recorder's handlers are set up once, so they read the conversation from here
+  const conversationIdRef = useRef<string>(conversationId);
+  conversationIdRef.current = conversationId;
 
   useEffect(() => {
     async function getMicrophone() {
@@ -29,6 +35,15 @@ const AudioRecorder: React.FC<AudioProps> = ({ socket, conversationId,
         };
 
         mediaRecorder.onstop = async () => {
+          if (stoppingHandsFree.current) {
+            // The last chunk is out, so the server can drop its hands-free stream
+            stoppingHandsFree.current = false;
+            socket.send(JSON.stringify({ v: 1, type: 'session.start', mode: 'push_to_talk', conversationId: conversationIdRef.current }));
+            onUpdateStatus('Press and hold Space Bar to record');
+            return;
+          }
+          // The last chunk comes in a dataavailable event after stop(), so only now is all the audio out
+          socket.send(JSON.stringify({ v: 1, type: 'audio.end', conversationId: conversationIdRef.current }));
           await handleStopRecording();
         };
 
@@ -47,27 +62,43 @@ const AudioRecorder: React.FC<AudioProps> = ({ socket, conversationId,
   };
 
   const startRecording = () => {
+    // Starting to talk cuts off whatever the bot is saying
+    onInterrupt();
     audioRecorder?.start(200);
     setRecording(true);
     onUpdateStatus('Recording started...');
   };
 
   const stopRecording = () => {
-    audioRecorder?.stop();
-    socket.send(JSON.stringify({ type: 'audioEnd', conversationId }));
+    audioRecorder?.stop(); // audio.end goes out from onstop
   };
 
 
+  // Hands-free: the microphone stays on and the server decides when the user is done talking
+  useEffect(() => {
+    if (!audioRecorder) {
+      return;
+    }
+    if (handsFree) {
+      socket.send(JSON.stringify({ v: 1, type: 'session.start', mode: 'hands_free', conversationId }));
+      audioRecorder.start(200);
+      onUpdateStatus('Hands-free: just talk, the bot answers when you pause');
+    } else if (audioRecorder.state === 'recording') {
+      stoppingHandsFree.current = true;
+      audioRecorder.stop();
+    }
+  }, [handsFree, audioRecorder]);
+
   // Keyboard event handlers for starting and stopping the audio recorder.
   useEffect(() => {
     const downHandler = (event: KeyboardEvent) => {
-      if (event.key === ' ' && audioRecorder && !recording) {
+      if (event.key === ' ' && audioRecorder && !recording && !handsFree) {
         startRecording();
       }
     };
 
     const upHandler = (event: KeyboardEvent) => {
-      if (event.key === ' ' && audioRecorder && recording) {
+      if (event.key === ' ' && audioRecorder && recording && !handsFree) {
         stopRecording();
       }
     };
@@ -79,7 +110,7 @@ const AudioRecorder: React.FC<AudioProps> = ({ socket, conversationId,
       window.removeEventListener('keydown', downHandler);
       window.removeEventListener('keyup', upHandler);
     };
-  }, [audioRecorder, recording]);
+  }, [audioRecorder, recording, handsFree]);
 
   return <div>
     {/* Additional UI can go here */}
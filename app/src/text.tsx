@@ -1,8 +1,27 @@
 import { useState, useEffect, useRef } from 'react';
 
+// A recognized word of the user's speech, with its timing and how sure the STT engine was
+export interface Word {
+  word: string;
+  start: number;
+  end: number;
+  confidence: number;
+  speaker?: number; // only with diarization
+}
+
 interface Message {
   text: string;
   isUser: boolean;
+  words?: Word[]; // only for spoken user messages
+  audioUrl?: string; // where to fetch a bot reply's audio again, when the server keeps it
+}
+
+// Where the conversation's debate is, from the phase.start and phase.end events
+export interface DebatePhase {
+  phase: string; // empty once the debate is over
+  resolution: string;
+  userSide: string; // for or against, the bot argues the other side
+  endsAt: number; // Date.now() time the phase runs out
 }
 
 interface UseTextStreamProps {
@@ -16,6 +35,25 @@ type IncomingChunk = {
   content: string;
   role: string;
   name: string;
+  words?: Word[];
+  audioUrl?: string;
+};
+
+// Every server event is wrapped in this envelope, see server/protocol/schema.json
+type Envelope = {
+  v: number;
+  type: string;
+  turnId: number;
+  seq: number;
+  payload: any;
+};
+
+const PROTOCOL_VERSION = 1;
+
+// Turns base64 audio from a bot.audio.chunk event into a playable blob
+const decodeAudio = (data: string, mimeType: string): Blob => {
+  const bytes = Uint8Array.from(atob(data), (c) => c.charCodeAt(0));
+  return new Blob([bytes], { type: mimeType });
 };
 
 export const useTextStream = ({
@@ -29,17 +67,44 @@ export const useTextStream = ({
   const [currentBotMessage, setCurrentBotMessage] = useState('');
   const [currentUserMessage, setCurrentUserMessage] = useState('');
   const [incomingChunks, setIncomingChunks] = useState<IncomingChunk[]>([]);
+  const [error, setError] = useState<string>(''); // Last error reported by the server
+  const [debate, setDebate] = useState<DebatePhase | null>(null); // null unless the conversation is a debate
   const [messageIndex, setMessageIndex] = useState(0); // Add index to track message changes
-  const audioQueue = useRef<Blob[]>([]); // Queue for audio blobs
+  const audioQueue = useRef<{ blob: Blob; turnId: number }[]>([]); // Queue for audio blobs
+  const playingTurn = useRef<number>(-1); // Turn of the audio being played
+  const currentTurn = useRef<number>(-1); // Latest turn the server has sent events for
+  const interruptedTurn = useRef<number>(-1); // Events for this turn and older are dropped
+  const sentenceChunks = useRef<{ turnId: number; mimeType: string; parts: Blob[] }>({ turnId: -1, mimeType: '', parts: [] }); // Audio of the sentence being streamed
+
+  // Stops whatever the bot is saying and drops any audio still queued up
+  const stopPlayback = () => {
+    audioQueue.current = [];
+    if (audioElement.current) {
+      audioElement.current.pause();
+      audioElement.current.removeAttribute('src');
+    }
+  };
+
+  // Barge-in: tell the server to cut off the bot's current turn
+  const interrupt = () => {
+    stopPlayback();
+    interruptedTurn.current = currentTurn.current;
+    socket.send(JSON.stringify({ v: PROTOCOL_VERSION, type: 'interrupt', conversationId }));
+  };
 
   const handleSubmit = () => {
     if (input.trim()) {
+      stopPlayback();
+      setError('');
+      interruptedTurn.current = currentTurn.current;
       const newMessages = [...messages, { text: input, isUser: true }];
       setMessages(newMessages);
 
       // Send the message as a JSON string
       socket.send(
         JSON.stringify({
+          v: PROTOCOL_VERSION,
+          type: 'user.text',
           conversationId: conversationId,
           text: input,
         })
@@ -54,9 +119,10 @@ export const useTextStream = ({
 
   const playNextAudio = () => {
     if (audioQueue.current.length > 0) {
-      const nextAudioBlob = audioQueue.current.shift(); // Get the next audio blob
-      if (nextAudioBlob && audioElement.current) {
-        const audioUrl = URL.createObjectURL(nextAudioBlob);
+      const next = audioQueue.current.shift(); // Get the next audio blob
+      if (next && audioElement.current) {
+        playingTurn.current = next.turnId;
+        const audioUrl = URL.createObjectURL(next.blob);
         audioElement.current.src = audioUrl;
         audioElement.current.play();
       }
@@ -65,28 +131,105 @@ export const useTextStream = ({
 
   useEffect(() => {
     socket.onmessage = (event) => {
-      console.log(`Received ${typeof event.data} packet of size ${event.data.size || event.data.length}`);
-      if (event.data instanceof Blob) {
-        console.log("Received audio data");
-        event.data.arrayBuffer().then(buffer => {
-          console.log("ArrayBuffer content:", new Uint8Array(buffer));
-        }).catch(error => {
-          console.error("Error reading Blob data:", error);
-        });
-        audioQueue.current.push(event.data); // Add incoming audio blob to the queue
-        if (audioElement.current?.paused) {
-          playNextAudio(); // Play immediately if not playing anything else
+      let envelope: Envelope;
+      try {
+        envelope = JSON.parse(event.data);
+      } catch (error) {
+        console.error('Error parsing message:', error);
+        return;
+      }
+      if (envelope.v !== PROTOCOL_VERSION) {
+        console.error(`Unsupported protocol version ${envelope.v}`);
+        return;
+      }
+      // The debate's clock comes with the turn that's listening but isn't part of any reply,
+      // so it's never stale and doesn't make that turn the one to cut off
+      const isPhase = envelope.type === 'phase.start' || envelope.type === 'phase.end';
+      if (!isPhase) {
+        // Anything still arriving for a turn we cut off is stale
+        if (envelope.turnId <= interruptedTurn.current && envelope.type !== 'turn.done') {
+          return;
         }
-      } else {
-        try {
-          const parsedMessage = JSON.parse(event.data);
-          if (parsedMessage && typeof parsedMessage.content === 'string') {
-            // Handle incoming chunks
-            setIncomingChunks((prev) => [...prev, parsedMessage]);
+        currentTurn.current = Math.max(currentTurn.current, envelope.turnId);
+      }
+
+      switch (envelope.type) {
+        case 'transcript.interim':
+          // A guess at what the user is saying, replaced by the next interim or final
+          setCurrentUserMessage(envelope.payload.text);
+          break;
+        case 'transcript.final':
+          setCurrentUserMessage('');
+          setIncomingChunks((prev) => [
+            ...prev,
+            { content: envelope.payload.text, role: 'user', name: 'user', words: envelope.payload.words },
+          ]);
+          break;
+        case 'bot.text.delta':
+          setIncomingChunks((prev) => [...prev, { content: envelope.payload.text, role: 'bot', name: 'bot' }]);
+          break;
+        case 'bot.audio.chunk':
+          // Sentences arrive one after the other, so only one is ever being collected
+          if (envelope.payload.chunk === 0) {
+            sentenceChunks.current = { turnId: envelope.turnId, mimeType: envelope.payload.mimeType, parts: [] };
+          }
+          sentenceChunks.current.parts.push(decodeAudio(envelope.payload.data, envelope.payload.mimeType));
+          break;
+        case 'bot.audio.end': {
+          // The sentence's chunks together make one playable file
+          const sentence = sentenceChunks.current;
+          sentenceChunks.current = { turnId: -1, mimeType: '', parts: [] };
+          if (envelope.payload.chunks === 0 || sentence.turnId !== envelope.turnId) {
+            break;
+          }
+          audioQueue.current.push({
+            blob: new Blob(sentence.parts, { type: sentence.mimeType }),
+            turnId: envelope.turnId,
+          });
+          if (audioElement.current?.paused) {
+            playNextAudio(); // Play immediately if not playing anything else
           }
-        } catch (error) {
-          console.error('Error parsing message:', error);
+          break;
         }
+        case 'turn.done':
+          console.log(`Turn ${envelope.turnId} done`, envelope.payload);
+          setCurrentUserMessage('');
+          if (envelope.payload.audioUrl) {
+            // Queued behind the reply's text so it ends up on the right message.
+            // The path is on the Go server, which isn't where the page is served from.
+            const audioUrl = new URL(envelope.payload.audioUrl, socket.url.replace(/^ws/, 'http')).toString();
+            setIncomingChunks((prev) => [...prev, { content: '', role: 'bot', name: 'bot', audioUrl }]);
+          }
+          if (envelope.payload.interrupted) {
+            // The server cut the reply off, e.g. the user started talking in hands-free mode
+            audioQueue.current = audioQueue.current.filter((item) => item.turnId !== envelope.turnId);
+            if (playingTurn.current === envelope.turnId && audioElement.current) {
+              audioElement.current.pause();
+              audioElement.current.removeAttribute('src');
+              playNextAudio();
+            }
+          }
+          break;
+        case 'phase.start':
+          setDebate({
+            phase: envelope.payload.phase,
+            resolution: envelope.payload.resolution,
+            userSide: envelope.payload.userSide,
+            endsAt: Date.now() + envelope.payload.remainingMs,
+          });
+          break;
+        case 'phase.end':
+          // The next phase, if there is one, comes with its own phase.start
+          if (!envelope.payload.next) {
+            setDebate((prev) => prev && { ...prev, phase: '', endsAt: Date.now() });
+          }
+          break;
+        case 'error':
+          console.error(`Server error (${envelope.payload.code}): ${envelope.payload.message}`);
+          setError(envelope.payload.message);
+          break;
+        default:
+          console.log(`Ignoring ${envelope.type} event`);
       }
     };
 
@@ -118,6 +261,8 @@ export const useTextStream = ({
             updatedMessages[lastMessageIndex] = {
               ...lastMessage,
               text: lastMessage.text + chunk.content,
+              words: chunk.words ? [...(lastMessage.words ?? []), ...chunk.words] : lastMessage.words,
+              audioUrl: chunk.audioUrl ?? lastMessage.audioUrl,
             };
             return updatedMessages;
           } else {
@@ -125,6 +270,8 @@ export const useTextStream = ({
             const newMessage = {
               text: chunk.content,
               isUser: isUserMessage,
+              words: chunk.words,
+              audioUrl: chunk.audioUrl,
             };
             setMessageIndex((prev) => prev + 1); // Increment index for new message
             return [...prevMessages, newMessage];
@@ -145,5 +292,8 @@ export const useTextStream = ({
     currentBotMessage,
     currentUserMessage,
     handleSubmit,
+    interrupt,
+    error,
+    debate,
   };
 };
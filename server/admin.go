@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"go-websocket-server/protocol"
+	"go-websocket-server/utils"
+	"log"
+	"net/http"
+)
+
+// requireAdmin only lets requests with the admin token through
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expected := []byte("Bearer " + cfg.Admin.Token)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// lexiconAdmin serves the endpoints that edit the pronunciation lexicon
+type lexiconAdmin struct {
+	lexicon *utils.Lexicon
+}
+
+func (a lexiconAdmin) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.lexicon.Entries())
+}
+
+// set adds or replaces a pronunciation, the body is a utils.Pronunciation
+func (a lexiconAdmin) set(w http.ResponseWriter, r *http.Request) {
+	var p utils.Pronunciation
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.lexicon.Set(p); err != nil {
+		log.Printf("Failed to save pronunciation: %v", err)
+		http.Error(w, "failed to save the pronunciation", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Pronunciation of %q set", p.Word)
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (a lexiconAdmin) remove(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.lexicon.Remove(r.PathValue("word"))
+	if err != nil {
+		log.Printf("Failed to remove pronunciation: %v", err)
+		http.Error(w, "failed to remove the pronunciation", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Pronunciation of %q removed", r.PathValue("word"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reload picks up changes made to the pronunciations table behind the server's back
+func (a lexiconAdmin) reload(w http.ResponseWriter, r *http.Request) {
+	if err := a.lexicon.Reload(); err != nil {
+		log.Printf("Failed to reload the lexicon: %v", err)
+		http.Error(w, "failed to reload the lexicon", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.lexicon.Entries())
+}
+
+func listPersonas(w http.ResponseWriter, r *http.Request) {
+	personas, err := utils.GetPersonas()
+	if err != nil {
+		log.Printf("Failed to list personas: %v", err)
+		http.Error(w, "failed to list the personas", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, personas)
+}
+
+// savePersona adds or replaces a persona, the body is a utils.Persona
+func savePersona(w http.ResponseWriter, r *http.Request) {
+	var p utils.Persona
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Better to find out now than on the first turn that uses it
+	if err := providers.STT.ValidateListen(protocol.ListenOptions{Language: p.STTLanguage}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := utils.SavePersona(p); err != nil {
+		log.Printf("Failed to save persona: %v", err)
+		http.Error(w, "failed to save the persona", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Persona %q saved", p.ID)
+	writeJSON(w, http.StatusOK, p)
+}
+
+func deletePersona(w http.ResponseWriter, r *http.Request) {
+	ok, err := utils.DeletePersona(r.PathValue("id"))
+	if err != nil {
+		log.Printf("Failed to delete persona: %v", err)
+		http.Error(w, "failed to delete the persona", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Persona %q deleted", r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
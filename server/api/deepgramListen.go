@@ -0,0 +1,91 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"go-websocket-server/protocol"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Model families Deepgram's live API accepts, optionally with a variant like nova-2-phonecall
+var deepgramModel = regexp.MustCompile(`^(nova-3|nova-2|nova|enhanced|base)(-[a-z]+)?$`)
+
+// BCP-47 language tag such as en, en-US or zh-Hant, or multi for code switching
+var deepgramLanguage = regexp.MustCompile(`^([a-z]{2,3}(-[A-Za-z0-9]{2,8})*|multi)$`)
+
+// A word or short phrase to boost, with an optional intensifier like :2 or :-1.5
+var deepgramKeyword = regexp.MustCompile(`^[\p{L}\p{N}' -]{1,50}(:-?[0-9]+(\.[0-9]+)?)?$`)
+
+// Raw audio encodings Deepgram can decode without a container
+var deepgramEncodings = map[string]bool{
+	"linear16": true, "linear32": true, "flac": true, "alaw": true, "mulaw": true,
+	"amr-nb": true, "amr-wb": true, "opus": true, "ogg-opus": true, "speex": true, "g729": true,
+}
+
+const maxDeepgramKeywords = 100
+
+// validateDeepgramListen checks listen options against what Deepgram accepts,
+// so nothing the client sends ends up in the URL unchecked
+func validateDeepgramListen(listen protocol.ListenOptions) error {
+	var errs []error
+	if listen.Model != "" && !deepgramModel.MatchString(listen.Model) {
+		errs = append(errs, fmt.Errorf("unsupported model %q", listen.Model))
+	}
+	if listen.Language != "" && !deepgramLanguage.MatchString(listen.Language) {
+		errs = append(errs, fmt.Errorf("invalid language %q", listen.Language))
+	}
+	if len(listen.Keywords) > maxDeepgramKeywords {
+		errs = append(errs, fmt.Errorf("at most %d keywords are allowed, got %d", maxDeepgramKeywords, len(listen.Keywords)))
+	}
+	for _, keyword := range listen.Keywords {
+		if !deepgramKeyword.MatchString(keyword) {
+			errs = append(errs, fmt.Errorf("invalid keyword %q", keyword))
+		}
+	}
+	if listen.Encoding != "" && !deepgramEncodings[listen.Encoding] {
+		errs = append(errs, fmt.Errorf("unsupported encoding %q", listen.Encoding))
+	}
+	switch {
+	case listen.Encoding != "" && listen.SampleRate == 0:
+		errs = append(errs, fmt.Errorf("sampleRate is required with encoding %s", listen.Encoding))
+	case listen.Encoding == "" && listen.SampleRate != 0:
+		errs = append(errs, errors.New("sampleRate only applies to raw audio, set encoding too"))
+	case listen.SampleRate != 0 && (listen.SampleRate < 8000 || listen.SampleRate > 48000):
+		errs = append(errs, fmt.Errorf("sampleRate must be between 8000 and 48000, got %d", listen.SampleRate))
+	}
+	return errors.Join(errs...)
+}
+
+// addDeepgramListen sets the query parameters for validated listen options
+func addDeepgramListen(query url.Values, listen protocol.ListenOptions) {
+	if listen.Model != "" {
+		query.Set("model", listen.Model)
+	}
+	if listen.Language != "" {
+		query.Set("language", listen.Language)
+	}
+	setBool := func(key string, value *bool) {
+		if value != nil {
+			query.Set(key, strconv.FormatBool(*value))
+		}
+	}
+	setBool("smart_format", listen.SmartFormat)
+	setBool("punctuate", listen.Punctuate)
+	setBool("diarize", listen.Diarize)
+	for _, keyword := range listen.Keywords {
+		// Nova-3 replaced keywords with keyterm prompting, which has no intensifiers
+		if strings.HasPrefix(listen.Model, "nova-3") {
+			term, _, _ := strings.Cut(keyword, ":")
+			query.Add("keyterm", term)
+		} else {
+			query.Add("keywords", keyword)
+		}
+	}
+	if listen.Encoding != "" {
+		query.Set("encoding", listen.Encoding)
+		query.Set("sample_rate", strconv.Itoa(listen.SampleRate))
+	}
+}
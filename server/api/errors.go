@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorKind sorts provider failures into the few cases a client can act on
+type ErrorKind string
+
+const (
+	ErrAuth                ErrorKind = "auth"                 // bad or missing API key
+	ErrRateLimit           ErrorKind = "rate_limit"           // the provider wants us to slow down
+	ErrUpstreamUnavailable ErrorKind = "upstream_unavailable" // provider down, network trouble, unexpected responses
+	ErrBadInput            ErrorKind = "bad_input"            // the provider refused what we sent it
+)
+
+// ProviderError is returned by the LLM, STT and TTS providers when a call fails
+type ProviderError struct {
+	Kind     ErrorKind
+	Provider string // e.g. "groq", "deepgram"
+	Err      error
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Provider, e.Kind, e.Err)
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// UserMessage explains the error without leaking provider details to the client
+func (e *ProviderError) UserMessage() string {
+	switch e.Kind {
+	case ErrAuth:
+		return fmt.Sprintf("The server could not authenticate with %s.", e.Provider)
+	case ErrRateLimit:
+		return fmt.Sprintf("Too many requests to %s, please try again in a moment.", e.Provider)
+	case ErrBadInput:
+		return fmt.Sprintf("The request was rejected by %s.", e.Provider)
+	default:
+		return fmt.Sprintf("Could not reach %s right now.", e.Provider)
+	}
+}
+
+// newStatusError classifies a failed HTTP response by its status code
+func newStatusError(provider string, statusCode int, body string) *ProviderError {
+	kind := ErrUpstreamUnavailable
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		kind = ErrAuth
+	case statusCode == http.StatusTooManyRequests:
+		kind = ErrRateLimit
+	case statusCode >= 400 && statusCode < 500:
+		kind = ErrBadInput
+	}
+	return &ProviderError{
+		Kind:     kind,
+		Provider: provider,
+		Err:      fmt.Errorf("status %d: %s", statusCode, body),
+	}
+}
+
+// newUnavailableError wraps network and protocol failures
+func newUnavailableError(provider string, err error) error {
+	// Cancellation is not the provider's fault, let callers recognize it
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	return &ProviderError{Kind: ErrUpstreamUnavailable, Provider: provider, Err: err}
+}
+
+// AsProviderError turns any error into a ProviderError,
+// treating unknown errors as the provider being unavailable
+func AsProviderError(err error) *ProviderError {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr
+	}
+	return &ProviderError{Kind: ErrUpstreamUnavailable, Provider: "the server", Err: err}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"go-websocket-server/config"
+	"go-websocket-server/utils"
+)
+
+// LLMProvider is anything that can stream a chat completion.
+// StreamChat sends each piece of generated text into deltas as soon as it arrives
+// and returns once the reply is complete. It must not close deltas,
+// the caller owns that channel.
+type LLMProvider interface {
+	StreamChat(ctx context.Context, messages []utils.MessageObj, opts ChatOptions, deltas chan<- string) error
+}
+
+// ChatOptions tune a single completion, e.g. for the conversation's persona.
+// Unset fields keep the provider's defaults.
+type ChatOptions struct {
+	Model       string
+	Temperature *float64
+}
+
+// NewLLMProvider builds the LLM backend chosen in cfg.Provider.
+// "groq" talks to Groq's hosted API,
+// "openai" talks to any OpenAI-compatible server at cfg.BaseURL (vLLM, llama.cpp server, Ollama...),
+// and "fake" replays canned replies so the pipeline can run without a network.
+func NewLLMProvider(cfg config.LLMConfig) (LLMProvider, error) {
+	switch cfg.Provider {
+	case "groq":
+		provider := NewGroqProvider(cfg.APIKey)
+		if cfg.Model != "" {
+			provider.Model = cfg.Model
+		}
+		return provider, nil
+	case "openai":
+		return NewOpenAICompatibleProvider(cfg.BaseURL, cfg.APIKey, cfg.Model), nil
+	case "fake":
+		return NewFakeLLMProvider(), nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q", cfg.Provider)
+	}
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+	"go-websocket-server/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeLLMProvider replays a script of canned replies, one per call,
+// streaming each reply word by word. Handy for tests and for running
+// the voice loop without an API key.
+type FakeLLMProvider struct {
+	Replies []string      // played in order, wrapping around at the end
+	Delay   time.Duration // pause between words to mimic a real stream
+
+	mu   sync.Mutex
+	next int
+}
+
+func NewFakeLLMProvider(replies ...string) *FakeLLMProvider {
+	if len(replies) == 0 {
+		replies = []string{"This is a scripted reply. The real model is not connected right now."}
+	}
+	return &FakeLLMProvider{
+		Replies: replies,
+		Delay:   20 * time.Millisecond,
+	}
+}
+
+func (p *FakeLLMProvider) StreamChat(ctx context.Context, messages []utils.MessageObj, opts ChatOptions, deltas chan<- string) error {
+	p.mu.Lock()
+	reply := p.Replies[p.next%len(p.Replies)]
+	p.next++
+	p.mu.Unlock()
+
+	words := strings.SplitAfter(reply, " ")
+	for _, word := range words {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.Delay):
+		}
+		deltas <- word
+	}
+	return nil
+}
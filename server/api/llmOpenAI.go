@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-websocket-server/utils"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const groqBaseURL = "https://api.groq.com/openai/v1"
+
+// ChatCompletionRequest is the body of an OpenAI-style /chat/completions call
+type ChatCompletionRequest struct {
+	Messages    []utils.MessageObj `json:"messages"`
+	Model       string             `json:"model"`
+	Temperature *float64           `json:"temperature,omitempty"`
+	Stream      bool               `json:"stream"`
+}
+type Choice struct {
+	Delta struct {
+		Content string `json:"content"`
+	} `json:"delta"`
+}
+
+// ChatCompletionChunk is a single server-sent event from a streamed completion
+type ChatCompletionChunk struct {
+	Choices []Choice `json:"choices"`
+}
+
+// OpenAICompatibleProvider streams completions from any server that speaks
+// the OpenAI chat completions API: Groq, vLLM, llama.cpp server, Ollama, etc.
+type OpenAICompatibleProvider struct {
+	Name    string // shown in errors, e.g. Groq
+	BaseURL string // e.g. http://localhost:11434/v1, without the trailing /chat/completions
+	APIKey  string // optional, local servers usually don't need one
+	Model   string
+	Client  *http.Client
+}
+
+func NewOpenAICompatibleProvider(baseURL, apiKey, model string) *OpenAICompatibleProvider {
+	return &OpenAICompatibleProvider{
+		Name:    "the LLM server",
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		APIKey:  apiKey,
+		Model:   model,
+		Client:  &http.Client{},
+	}
+}
+
+// NewGroqProvider returns a provider pointed at Groq's hosted Llama 3.1 8B
+func NewGroqProvider(apiKey string) *OpenAICompatibleProvider {
+	provider := NewOpenAICompatibleProvider(groqBaseURL, apiKey, "llama-3.1-8b-instant")
+	provider.Name = "Groq"
+	return provider
+}
+
+func (p *OpenAICompatibleProvider) StreamChat(ctx context.Context, messages []utils.MessageObj, opts ChatOptions, deltas chan<- string) error {
+	postData := ChatCompletionRequest{
+		Messages:    messages,
+		Model:       p.Model,
+		Temperature: opts.Temperature,
+		Stream:      true,
+	}
+	if opts.Model != "" {
+		postData.Model = opts.Model
+	}
+	jsonData, err := json.Marshal(postData)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	// Create a POST request with JSON body
+	req, err := http.NewRequestWithContext(ctx, "POST", p.BaseURL+"/chat/completions", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return newUnavailableError(p.Name, fmt.Errorf("failed to make request: %w", err))
+	}
+	defer resp.Body.Close()
+
+	// Check the response status code
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return newStatusError(p.Name, resp.StatusCode, string(body))
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return newUnavailableError(p.Name, fmt.Errorf("error reading response: %w", err))
+		}
+
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "data: ")
+		if line == "[DONE]" {
+			return nil
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			log.Printf("Failed to decode JSON: %v", err)
+			continue
+		}
+
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			deltas <- chunk.Choices[0].Delta.Content
+		}
+	}
+}
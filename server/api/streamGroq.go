@@ -1,46 +1,31 @@
 package api
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
-	"fmt"
+	"context"
+	"go-websocket-server/protocol"
 	"go-websocket-server/utils"
-	"io"
 	"log"
-	"net/http"
-	"os"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
 )
 
-type GroqPostData struct {
-	Messages []utils.MessageObj `json:"messages"` // Change to a slice directly
-	Model    string             `json:"model"`    // Make field exported with JSON tag
-	Stream   bool               `json:"stream"`   // Make field exported with JSON tag
-}
-type Choice struct {
-	Delta struct {
-		Content string `json:"content"`
-	} `json:"delta"`
-}
-type Data struct {
-	Choices []Choice `json:"choices"`
-}
-
 // Main function to interact with the LLM
 // Fetches history from sqlite
-// then sends the whole packet to the LLM
-// and streams its response into outputChan
+// then sends the whole packet, after systemPrompt if there is one, to the LLM provider
+// and streams its response into textForClient and textForTTS
 // The completed response is then sent to deepgram TTS
 // which will output to audioChan
-func AskLlama(conversationId string, userMessage string, textForClient chan<- string, textForTTS chan<- string) {
-	url := "https://api.groq.com/openai/v1/chat/completions"
-
+// The user's words, if they spoke, are saved along with their message.
+// With diarization, each speaker's part is saved as its own message named after them.
+// A recording of the user's audio is saved to disk and its path stored on their message.
+// If ctx is cancelled mid-reply (the user barged in), streaming stops
+// and only the part of the reply already sent to the client is saved.
+// Returns the index the reply was saved at, -1 if there was nothing to save,
+// and the provider's error if the LLM call failed.
+func AskLlama(ctx context.Context, llm LLMProvider, opts ChatOptions, systemPrompt string, historyWindow int, conversationId string, userMessage Transcript, textForClient chan<- string, textForTTS chan<- string) (int, error) {
 	// Get conversation history
-	history, err := utils.GetConversationHistory(conversationId)
+	history, err := utils.GetConversationHistory(conversationId, historyWindow)
 	if err != nil {
 		log.Printf("Failed to get conversation history: %v", err)
 		history = []utils.MessageObj{}
@@ -52,122 +37,82 @@ func AskLlama(conversationId string, userMessage string, textForClient chan<- st
 		nextIndex = 0
 	}
 
-	// Add the new user message
-	userMsg := utils.MessageObj{
-		Role:    "user",
-		Name:    "user",
-		Content: userMessage,
-	}
-	messages := append(history, userMsg)
-
-	// Save the user message to the database
-	err = utils.SaveMessage(conversationId, nextIndex, userMsg.Role, userMsg.Name, userMsg.Content)
-	if err != nil {
-		log.Printf("Failed to save user message: %v", err)
+	// The system prompt isn't saved, it always goes first
+	var messages []utils.MessageObj
+	if systemPrompt != "" {
+		messages = append(messages, utils.MessageObj{Role: "system", Name: "system", Content: systemPrompt})
 	}
-	nextIndex++
-
-	// Convert db.MessageObj to MessageObj for the API request
-	apiMessages := make([]utils.MessageObj, len(messages))
-	for i, msg := range messages {
-		apiMessages[i] = utils.MessageObj{
-			Role:    msg.Role,
-			Name:    msg.Name,
-			Content: msg.Content,
+	messages = append(messages, history...)
+
+	// Add the new user message, one per speaker
+	firstIndex := nextIndex
+	for _, segment := range userMessage.Segments() {
+		userMsg := utils.MessageObj{
+			Role:    "user",
+			Name:    segment.Name(),
+			Content: segment.Text,
 		}
-	}
-
-	groqPostData := GroqPostData{
-		Messages: apiMessages,
-		Model:    "llama-3.1-8b-instant",
-		Stream:   true,
-	}
-
-	jsonData, err := json.Marshal(groqPostData)
-	fmt.Println(string(jsonData))
-	// Create a POST request with JSON body
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Fatalf("Failed to create request: %v", err)
-	}
-
-	// Set the Content-Type header
-	req.Header.Set("Content-Type", "application/json")
+		messages = append(messages, userMsg)
 
-	// Add the API key to the header
-	apiErr := utils.LoadEnv(".env")
-	if apiErr != nil {
-		log.Fatal("Error loading .env file:", apiErr)
+		// Save the user message to the database
+		err = utils.SaveMessage(conversationId, nextIndex, userMsg.Role, userMsg.Name, userMsg.Content)
+		if err != nil {
+			log.Printf("Failed to save user message: %v", err)
+		} else if err := utils.SaveMessageWords(conversationId, nextIndex, segment.Words); err != nil {
+			log.Printf("Failed to save the words of the user message: %v", err)
+		}
+		nextIndex++
 	}
+	saveRecording(conversationId, firstIndex, nextIndex, userMessage.Audio)
 
-	apiKey := os.Getenv("GROQ_API_KEY")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	// Stream the reply from the provider in the background
+	deltas := make(chan string)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- llm.StreamChat(ctx, messages, opts, deltas)
+		close(deltas)
+	}()
 
-	// Perform the POST request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatalf("Failed to make request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Check the response status code
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("API request failed with status code: %d",
-			resp.StatusCode)
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Response body: %s", string(body))
-		close(textForClient)
-		close(textForTTS)
-		return
-	}
 	// Initialize a string buffer to collect the entire bot response
 	var botResponseBuffer strings.Builder
-	reader := bufio.NewReader(resp.Body)
-
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Error reading response: %v", err)
-			break
-		}
-
-		line = strings.TrimSpace(line)
-		if !strings.HasPrefix(line, "data: ") {
+	for delta := range deltas {
+		// Once interrupted, keep draining so the provider can return
+		if ctx.Err() != nil {
 			continue
 		}
-
-		line = strings.TrimPrefix(line, "data: ")
-		if line == "[DONE]" {
-			break
-		}
-
-		var data Data
-		if err := json.Unmarshal([]byte(line), &data); err != nil {
-			log.Printf("Failed to decode JSON: %v", err)
+		// Stream data to text out channels
+		select {
+		case textForClient <- delta:
+		case <-ctx.Done():
 			continue
 		}
-
-		if len(data.Choices) > 0 && data.Choices[0].Delta.Content !=
-			"" {
-			// Accumulate the bot's response in a buffer
-			botResponseBuffer.WriteString(data.Choices[0].Delta.Content)
-			// Stream data to text out channels
-			textForClient <- string(data.Choices[0].Delta.Content)
-			textForTTS <- string(data.Choices[0].Delta.Content)
+		// Accumulate the bot's response in a buffer
+		botResponseBuffer.WriteString(delta)
+		select {
+		case textForTTS <- delta:
+		case <-ctx.Done():
 		}
 	}
+	llmErr := <-errChan
+	if llmErr != nil && ctx.Err() == nil {
+		log.Printf("LLM request failed: %v", llmErr)
+	} else {
+		llmErr = nil
+	}
+	if ctx.Err() != nil {
+		log.Println("Bot turn interrupted, saving the truncated response")
+	}
+
 	// Save the bot's response to the database
 	botResponse := botResponseBuffer.String()
+	replyIndex := -1
 	if botResponse != "" {
 		err := utils.SaveMessage(conversationId, nextIndex, "assistant", "assistant", botResponse)
 		if err != nil {
 			log.Printf("Failed to save bot response: %v", err)
 		} else {
 			log.Println("Bot response saved successfully: ", botResponse)
+			replyIndex = nextIndex
 		}
 	} else {
 		log.Println("Warning: Bot response was empty")
@@ -175,67 +120,122 @@ func AskLlama(conversationId string, userMessage string, textForClient chan<- st
 	// Close the results channel when done to signal completion
 	close(textForClient)
 	close(textForTTS)
+	return replyIndex, llmErr
+}
+
+// saveRecording writes the user's audio to disk and points their messages, from firstIndex up to endIndex, at it
+func saveRecording(conversationId string, firstIndex, endIndex int, recording *utils.Recording) {
+	path, err := recording.Save(conversationId, firstIndex)
+	if err != nil {
+		log.Printf("Failed to save the user's audio: %v", err)
+		return
+	}
+	if path == "" {
+		return
+	}
+	log.Println("User audio saved to", path)
+	for index := firstIndex; index < endIndex; index++ {
+		if err := utils.SetMessageAudioPath(conversationId, index, path); err != nil {
+			log.Printf("Failed to store the audio path of message %d: %v", index, err)
+		}
+	}
 }
 
 // Function that takes a stream of text as an input
-// Buffers it, then sends each full sentence to Deepgram TTS
-func BufferTextForTTS(inputStream chan string, audioOut chan<- []byte) {
-	rateLimitTicker := time.NewTicker(1 * time.Second)
-	var mu sync.Mutex
+// Buffers it, then sends each chunk the segmenter cuts, normally a full sentence, to the TTS provider.
+// Chunks go through the normalizer first so they're read the way a person would say them.
+// Sentences are synthesized concurrently and their audio is streamed as it comes,
+// but it goes out through a reorder stage so the client always hears them in order.
+// Cancelling ctx stops new TTS requests, aborts the ones in flight
+// and drops any audio that hasn't gone out yet.
+// Failed TTS requests are passed to onError; the reply carries on without that sentence's audio.
+// At most one TTS request is started per rateLimit interval.
+func BufferTextForTTS(ctx context.Context, tts TTSProvider, opts TTSOptions, segmenter *utils.Segmenter, normalizer *utils.Normalizer, rateLimit time.Duration, inputStream chan string, audioOut chan<- SentenceChunk, onError func(error)) {
+	rateLimitTicker := time.NewTicker(rateLimit)
 	var wg sync.WaitGroup
-	var textBuffer string
-	var eosRegex = regexp.MustCompile("([^!?\n]+[.!?\n])")
+
+	sentenceAudio := make(chan SentenceChunk)
+	reorderDone := make(chan struct{})
+	go func() {
+		ReorderAudio(ctx, sentenceAudio, audioOut)
+		close(reorderDone)
+	}()
+
+	// Every non-empty sentence gets the next sequence number
+	seq := 0
+	synthesize := func(text string) {
+		text = normalizer.Normalize(text)
+		if strings.TrimSpace(text) == "" || ctx.Err() != nil {
+			return
+		}
+		wg.Add(1)
+		go func(seq int, text string) {
+			defer wg.Done()
+			if err := synthesizeSentence(ctx, tts, opts, seq, text, rateLimitTicker, sentenceAudio); err != nil {
+				onError(err)
+			}
+		}(seq, text)
+		seq++
+	}
+
 	for text := range inputStream {
-		// Accumulate text in a per-sentence buffer
-		textBuffer += text
-		// Split sentence buffer by sentence (if applicable)
-		sentences := eosRegex.FindAllString(textBuffer, -1)
-		if len(sentences) > 1 {
-			//merge all but the last partial sentence into one text
-			text := strings.Trim(strings.Join(sentences[:len(sentences)-1], " "), " ")
-			// set the text buffer to the partial sentence and clear the sentences array
-			textBuffer = sentences[len(sentences)-1]
-			clear(sentences)
-			log.Println("Chunked sentence: ", text)
-			wg.Add(1)
-			go func(text string) {
-				defer wg.Done()
-				SendToDeepgramTTS(text, rateLimitTicker, &mu, audioOut)
-			}(text)
+		for _, sentence := range segmenter.Push(text) {
+			log.Println("Chunked sentence: ", sentence)
+			synthesize(sentence)
 		}
 	}
 	// Send whatever is left to TTS
-	log.Println("Remaining text: ", textBuffer)
-	wg.Add(1)
-	go func(text string) {
-		defer wg.Done()
-		SendToDeepgramTTS(text, rateLimitTicker, &mu, audioOut)
-	}(textBuffer)
+	for _, sentence := range segmenter.Flush() {
+		log.Println("Remaining text: ", sentence)
+		synthesize(sentence)
+	}
 	wg.Wait() // Wait for all goroutines to finish
+	close(sentenceAudio)
+	<-reorderDone
 	close(audioOut)
 	rateLimitTicker.Stop()
 }
 
-// Function that takes a stream of text as an input
-// Then puts the text in the right shape for a bot message before sending it to the client.
-func SendTextToClient(inputChannel chan string, writeChan chan<- utils.WebSocketPacket) {
-	fullTranscript := ""
-	for text := range inputChannel {
-		fullTranscript += text
-		// Put text into the right shape to send back to the frontend
-		msg := utils.MessageObj{
-			Content: text,
-			Role:    "bot",
-			Name:    "bot",
-		}
-		msgJSON, err := json.Marshal(msg)
-		if err != nil {
-			log.Println("Error marshalling JSON:", err)
-		}
-		writeChan <- utils.WebSocketPacket{
-			Type: utils.TextMessage,
-			Data: msgJSON,
+// Sends a single sentence to the TTS provider and streams its audio into out, chunk by chunk.
+// The ticker spaces out the start of each request, but requests may overlap.
+// A failed request still ends its sentence so the sentences after it aren't held up.
+func synthesizeSentence(ctx context.Context, tts TTSProvider, opts TTSOptions, seq int, text string, rateLimitTicker *time.Ticker, out chan<- SentenceChunk) error {
+	select {
+	case <-rateLimitTicker.C:
+	case <-ctx.Done():
+		return nil
+	}
+	send := func(chunk SentenceChunk) {
+		select {
+		case out <- chunk:
+		case <-ctx.Done():
 		}
+	}
 
+	chunks := make(chan []byte)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- tts.Synthesize(ctx, text, opts, chunks)
+		close(chunks)
+	}()
+	index := 0
+	for chunk := range chunks {
+		send(SentenceChunk{Seq: seq, Index: index, Audio: chunk})
+		index++
+	}
+	err := <-errChan
+	send(SentenceChunk{Seq: seq, Index: index, Last: true})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("TTS request for sentence %d failed: %v", seq, err)
+		return err
+	}
+	return nil
+}
+
+// Function that takes a stream of text as an input
+// Then sends each piece to the client as a bot.text.delta event.
+func SendTextToClient(ctx context.Context, inputChannel chan string, events *protocol.TurnWriter) {
+	for text := range inputChannel {
+		events.SendText(ctx, protocol.BotTextDelta, text)
 	}
 }
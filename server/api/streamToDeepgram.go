@@ -1,157 +1,516 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"go-websocket-server/protocol"
 	"go-websocket-server/utils"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
 )
 
+// Response is a Results message from Deepgram.
+// UtteranceEnd messages have a different shape and are only told apart by their type.
 type Response struct {
 	Type    string `json:"type"`
 	Channel struct {
 		Alternatives []struct {
-			Transcript string `json:"transcript"`
+			Transcript string  `json:"transcript"`
+			Confidence float64 `json:"confidence"`
+			Words      []struct {
+				Word           string  `json:"word"`
+				PunctuatedWord string  `json:"punctuated_word"` // only with punctuate or smart_format
+				Start          float64 `json:"start"`
+				End            float64 `json:"end"`
+				Confidence     float64 `json:"confidence"`
+				Speaker        *int    `json:"speaker"` // only with diarize
+			} `json:"words"`
 		} `json:"alternatives"`
 	} `json:"channel"`
+	IsFinal      bool    `json:"is_final"`     // the segment's text won't change anymore
+	SpeechFinal  bool    `json:"speech_final"` // endpointing detected the end of an utterance
+	FromFinalize bool    `json:"from_finalize"`
+	Start        float64 `json:"start"`    // offset of the segment in the stream, in seconds
+	Duration     float64 `json:"duration"` // length of the segment, in seconds
 }
 
-// NewDeepgramConnection initializes and returns a WebSocket connection to Deepgram
-func NewDeepgramConnection(outChan chan<- string, stopChan <-chan bool) (*websocket.Conn, error) {
-	apiErr := utils.LoadEnv(".env")
-	if apiErr != nil {
-		return nil, fmt.Errorf("error loading .env file: %w", apiErr)
+const deepgramListenURL = "wss://api.deepgram.com/v1/listen"
+
+// DeepgramSTT streams audio to Deepgram's live transcription websocket.
+// Listen holds the server's default recognition settings, which each stream can override.
+type DeepgramSTT struct {
+	APIKey string
+	URL    string
+	Listen protocol.ListenOptions
+}
+
+func NewDeepgramSTT(apiKey string) *DeepgramSTT {
+	return &DeepgramSTT{APIKey: apiKey, URL: deepgramListenURL}
+}
+
+// How often an idle connection is kept alive. Deepgram closes streams
+// that get no audio and no KeepAlive for about 10 seconds.
+const deepgramKeepAliveInterval = 4 * time.Second
+
+// How long to wait for the last transcripts once the stream is finalized
+const deepgramFinalizeTimeout = 5 * time.Second
+
+// Audio kept for replay after a dropped connection. Beyond this the stream stops
+// buffering, and a reconnect only gets the audio sent after it.
+const maxDeepgramReplayBytes = 8 << 20
+
+// How many times a finalized stream redials to get its last transcripts
+const maxDeepgramFinalizeRedials = 2
+
+// Replayed audio can be cut into segments a little differently the second time,
+// so a result has to end at least this far past the last forwarded one to count as new
+const deepgramReplayTolerance = 0.1 // seconds
+
+// deepgramStream is a managed connection to Deepgram's listen websocket.
+// Nothing is dialed until the first audio frame. An idle connection gets KeepAlive
+// messages, and a dropped one is redialed on the next audio frame: everything sent
+// since the start of the stream is replayed, so that containers like webm can be
+// decoded again, and results for audio that was already transcribed are skipped.
+// Transcripts keep flowing into the same events channel throughout.
+type deepgramStream struct {
+	stt    *DeepgramSTT
+	opts   STTOptions
+	events chan TranscriptEvent
+	stop   chan struct{} // closed once the stream is finalized or closed
+
+	mu         sync.Mutex // guards everything below and serializes writes to conn
+	conn       *websocket.Conn
+	lastWrite  time.Time
+	stopped    bool // Finalize or Close was called
+	closed     bool // Close was called, nothing more is wanted
+	redials    int  // after Finalize
+	audio      [][]byte
+	audioBytes int
+	overflowed bool    // audio went past maxDeepgramReplayBytes and isn't buffered anymore
+	finalEnd   float64 // end of the last final result forwarded, in seconds into the stream
+	closeOnce  sync.Once
+}
+
+func (d *DeepgramSTT) ValidateListen(listen protocol.ListenOptions) error {
+	if err := validateDeepgramListen(d.Listen.Merge(listen)); err != nil {
+		return &ProviderError{Kind: ErrBadInput, Provider: "Deepgram", Err: err}
+	}
+	return nil
+}
+
+// OpenStream checks the options, but unless opts.Prewarm is set
+// it doesn't connect until the first audio, see deepgramStream
+func (d *DeepgramSTT) OpenStream(ctx context.Context, opts STTOptions) (STTStream, error) {
+	opts.Listen = d.Listen.Merge(opts.Listen)
+	if err := d.ValidateListen(opts.Listen); err != nil {
+		return nil, err
+	}
+	s := &deepgramStream{
+		stt:    d,
+		opts:   opts,
+		events: make(chan TranscriptEvent),
+		stop:   make(chan struct{}),
 	}
+	if opts.Prewarm {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.dial(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
 
-	apiKey := os.Getenv("DEEPGRAM_API_KEY")
+// dial opens a new websocket to Deepgram, starts listening on it
+// and replays the buffered audio. The caller must hold s.mu.
+func (s *deepgramStream) dial() error {
 	headers := http.Header{}
-	headers.Set("Authorization", "Token "+apiKey)
+	headers.Set("Authorization", "Token "+s.stt.APIKey)
 
 	// Establish a WebSocket connection to the Deepgram API
-	const wsURL = "wss://api.deepgram.com/v1/listen"
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, headers)
+	conn, resp, err := websocket.DefaultDialer.Dial(s.listenURL(), headers)
 	if err != nil {
-		log.Fatal("Dial:", err)
-		return nil, err
+		if resp != nil {
+			// The handshake got an HTTP answer, so the status tells us what went wrong
+			body, _ := io.ReadAll(resp.Body)
+			return newStatusError("Deepgram", resp.StatusCode, string(body))
+		}
+		return newUnavailableError("Deepgram", fmt.Errorf("dial: %w", err))
 	}
 	log.Println("Connected to Deepgram STT")
 
-	go listenForResponses(conn, outChan, stopChan)
-	return conn, nil
+	// The new connection's timestamps start over. With the whole stream replayed they
+	// line up with the old ones, without it nothing can be matched up anymore.
+	if s.overflowed {
+		s.finalEnd = 0
+	}
+	s.conn = conn
+	s.lastWrite = time.Now()
+	done := make(chan struct{})
+	go s.listen(conn, s.finalEnd, done)
+	go s.keepAlive(conn, done)
+
+	if err := s.replay(conn); err != nil {
+		// Forget the connection, so its listener doesn't try to redial
+		s.conn = nil
+		conn.Close()
+		return newUnavailableError("Deepgram", fmt.Errorf("replay: %w", err))
+	}
+	return nil
 }
 
-// listenForResponses listens for responses from Deepgram
-func listenForResponses(conn *websocket.Conn, outChan chan<- string, stopChan <-chan bool) {
-	// Poll for incoming messages from the WebSocket
-	pongTimeout := time.Duration(4000 * time.Millisecond)
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(pongTimeout))
-		return nil
-	})
-	// By deferring stopping everything, we reduce copied code
-	defer func() {
-		log.Println("Closing listener output channel")
-		close(outChan)
-		log.Printf("Stopping deepgram websocket listener")
-		m := "{\"type\":\"CloseStream\"}"
-		err := conn.WriteMessage(websocket.TextMessage, []byte(m))
-		if err != nil {
+// replay sends the buffered audio on a new connection, and Finalize again if the stream
+// was already finalized. The caller must hold s.mu.
+func (s *deepgramStream) replay(conn *websocket.Conn) error {
+	if len(s.audio) > 0 {
+		log.Printf("Sending %d bytes of buffered audio to Deepgram", s.audioBytes)
+	}
+	for _, chunk := range s.audio {
+		if err := conn.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+			return err
+		}
+	}
+	if s.stopped {
+		// Don't wait forever if Deepgram has nothing left to say
+		conn.SetReadDeadline(time.Now().Add(deepgramFinalizeTimeout))
+		return s.writeControl("Finalize")
+	}
+	return nil
+}
+
+// listenURL adds the stream's options to the listen URL.
+// UtteranceEnd messages are only sent when interim results are on.
+func (s *deepgramStream) listenURL() string {
+	query := url.Values{}
+	addDeepgramListen(query, s.opts.Listen)
+	if s.opts.InterimResults || s.opts.HandsFree() {
+		query.Set("interim_results", "true")
+	}
+	if s.opts.Endpointing > 0 {
+		query.Set("endpointing", fmt.Sprint(s.opts.Endpointing.Milliseconds()))
+	}
+	if s.opts.UtteranceEnd > 0 {
+		query.Set("utterance_end_ms", fmt.Sprint(s.opts.UtteranceEnd.Milliseconds()))
+	}
+	if len(query) == 0 {
+		return s.stt.URL
+	}
+	separator := "?"
+	if strings.Contains(s.stt.URL, "?") {
+		separator = "&"
+	}
+	return s.stt.URL + separator + query.Encode()
+}
+
+// writeControl sends one of Deepgram's control messages, e.g. Finalize.
+// The caller must hold s.mu.
+func (s *deepgramStream) writeControl(messageType string) error {
+	m := fmt.Sprintf("{\"type\":%q}", messageType)
+	s.lastWrite = time.Now()
+	return s.conn.WriteMessage(websocket.TextMessage, []byte(m))
+}
+
+// listen runs listenForResponses on one connection and cleans up after it.
+// A connection that drops while the stream is still sending audio is redialed
+// by the next SendAudio. One that drops while waiting for the last transcripts
+// is redialed right away. The events channel is only closed once the stream
+// is stopped and no connection is left to deliver anything.
+func (s *deepgramStream) listen(conn *websocket.Conn, replayedUntil float64, done chan struct{}) {
+	err := s.listenForResponses(conn, replayedUntil)
+	close(done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != conn {
+		// Replaced by a reconnect, the new connection carries on
+		conn.Close()
+		return
+	}
+	log.Printf("Stopping deepgram websocket listener")
+	if err == nil {
+		if err := s.writeControl("CloseStream"); err != nil {
 			log.Printf("Error closing deepgram connection: %v", err)
 		}
-	}()
+	}
+	conn.Close()
+	s.conn = nil
+
+	if err != nil && s.stopped && !s.closed && !isTimeout(err) && s.redials < maxDeepgramFinalizeRedials {
+		log.Println("Lost connection to Deepgram before the last transcripts, reconnecting:", err)
+		s.redials++
+		if err := s.dial(); err == nil {
+			return
+		}
+		log.Println("Failed to reconnect to Deepgram:", err)
+	}
+	if s.stopped {
+		s.closeEvents()
+	}
+}
+
+// keepAlive sends KeepAlive whenever the connection has been quiet for a while,
+// until the connection's listener stops
+func (s *deepgramStream) keepAlive(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(deepgramKeepAliveInterval / 2)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-stopChan:
-			log.Println("Stop signal received")
+		case <-done:
 			return
-		default:
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err,
-					websocket.CloseGoingAway,
-					websocket.CloseAbnormalClosure) {
-					log.Printf("error: %v", err)
-					return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.conn == conn && time.Since(s.lastWrite) >= deepgramKeepAliveInterval {
+				if err := s.writeControl("KeepAlive"); err != nil {
+					log.Println("Error sending KeepAlive to Deepgram:", err)
 				}
-				log.Println("Error listening for responses:", err)
-				return
 			}
+			s.mu.Unlock()
+		}
+	}
+}
 
-			log.Printf("Received message from Deepgram: %s", message) // Log raw messages
-			var response Response
-			if err := json.Unmarshal(message, &response); err != nil {
-				log.Printf("Error decoding JSON message: %v", err)
-				continue
-			}
+func (s *deepgramStream) closeEvents() {
+	s.closeOnce.Do(func() {
+		log.Println("Closing listener output channel")
+		close(s.events)
+	})
+}
 
-			if response.Type == "Results" && len(response.Channel.Alternatives) > 0 {
-				for _, alternative := range response.Channel.Alternatives {
-					if alternative.Transcript != "" {
-						log.Println("Transcript sent to channel:", alternative.Transcript)
-						outChan <- alternative.Transcript + " " // Send the transcript through the channel
-					}
-				}
-				//Check for a stop signal after processing the websocket data too
-				// This way we don't have to wait for another websocket packet
-				// to check for a stop signal.
-				select {
-				case <-stopChan:
-					log.Println("Stop signal received")
-					return
-				default:
-					continue
-				}
-			}
+func (s *deepgramStream) SendAudio(audio []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return &ProviderError{Kind: ErrBadInput, Provider: "Deepgram", Err: fmt.Errorf("stream already finalized")}
+	}
+	s.bufferAudio(audio)
+	if s.conn != nil {
+		if err := s.conn.WriteMessage(websocket.BinaryMessage, audio); err == nil {
+			s.lastWrite = time.Now()
+			return nil
 		}
+		log.Println("Lost connection to Deepgram, reconnecting")
+		s.conn.Close()
+		s.conn = nil
 	}
+	// First audio of the stream, or the connection dropped: dial and replay
+	if s.overflowed {
+		// Nothing to replay, so at least this chunk has to go through
+		if err := s.dial(); err != nil {
+			return err
+		}
+		s.lastWrite = time.Now()
+		return s.conn.WriteMessage(websocket.BinaryMessage, audio)
+	}
+	return s.dial()
 }
 
-// Send transcript output back to the client in the right data shape
-// Receives a stream of text from input channel. The text is then put into the right
-// shape to send to the client as a user message.
-// Then the raw text is collected into a single full transcript
-// and this transcript is pushed into the output channel
-func SendTranscriptToClient(inputChannel chan string, outputChannel chan string, writeChan chan<- utils.WebSocketPacket, stopChan <-chan bool) {
-	var fullTranscript string // Accumulate the transcript
+// bufferAudio keeps audio for replay, up to maxDeepgramReplayBytes.
+// The caller must hold s.mu.
+func (s *deepgramStream) bufferAudio(audio []byte) {
+	if s.overflowed {
+		return
+	}
+	if s.audioBytes+len(audio) > maxDeepgramReplayBytes {
+		log.Println("Too much audio to replay after a reconnect, not buffering any more")
+		s.audio = nil
+		s.audioBytes = 0
+		s.overflowed = true
+		return
+	}
+	s.audio = append(s.audio, audio)
+	s.audioBytes += len(audio)
+}
 
-	for result := range inputChannel {
-		select {
-		case <-stopChan:
-			log.Printf("Stopping transcript stream to user")
-			break
+// Finalize sends Deepgram's special Finalize message so it flushes its cache,
+// then signals the listener to stop once the result it flushes is in.
+func (s *deepgramStream) Finalize() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
+	close(s.stop)
+	if s.conn == nil {
+		if len(s.audio) == 0 {
+			// No audio was ever sent, or none is left to replay, so nothing else is coming
+			s.closeEvents()
+			return nil
+		}
+		// The connection dropped with audio in flight, redial to get its transcript
+		if err := s.dial(); err != nil {
+			s.closeEvents()
+			return err
+		}
+		return nil
+	}
+	// Don't wait forever if Deepgram has nothing left to say
+	s.conn.SetReadDeadline(time.Now().Add(deepgramFinalizeTimeout))
+	return s.writeControl("Finalize")
+}
 
-		default:
-			log.Println("Transcript:", result)
-			fullTranscript += result
+func (s *deepgramStream) Events() <-chan TranscriptEvent {
+	return s.events
+}
 
-			// Create the JSON structure
-			response := utils.MessageObj{
-				Content: result,
-				Role:    "user",
-				Name:    "user",
+// Close stops the stream right away. CloseStream tells Deepgram we're done,
+// and closing the socket unblocks the listener, which then closes the events channel.
+func (s *deepgramStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+	}
+	s.closed = true
+	if s.conn == nil {
+		s.closeEvents()
+		return nil
+	}
+	if err := s.writeControl("CloseStream"); err != nil {
+		log.Printf("Error closing deepgram connection: %v", err)
+	}
+	return s.conn.Close()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// listenForResponses reads results from one connection until the stream is stopped
+// and the result flushed by Finalize is in, or until the connection fails.
+// Results that end before replayedUntil were already forwarded on a previous
+// connection and are skipped.
+func (s *deepgramStream) listenForResponses(conn *websocket.Conn, replayedUntil float64) error {
+	// Poll for incoming messages from the WebSocket
+	pongTimeout := time.Duration(4000 * time.Millisecond)
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongTimeout))
+		return nil
+	})
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err,
+				websocket.CloseGoingAway,
+				websocket.CloseAbnormalClosure) {
+				log.Printf("error: %v", err)
+				return err
 			}
+			log.Println("Error listening for responses:", err)
+			return err
+		}
 
-			// Marshal the struct to JSON
-			jsonResponse, err := json.Marshal(response)
-			if err != nil {
-				log.Println("Error marshaling JSON:", err)
+		log.Printf("Received message from Deepgram: %s", message) // Log raw messages
+		var response Response
+		if err := json.Unmarshal(message, &response); err != nil {
+			// UtteranceEnd's channel is a list, so it doesn't fit in Response
+			var header struct {
+				Type string `json:"type"`
+			}
+			if json.Unmarshal(message, &header) != nil {
+				log.Printf("Error decoding JSON message: %v", err)
 				continue
 			}
+			response.Type = header.Type
+		}
 
-			// Send the JSON to be written to the websocket
-			writeChan <- utils.WebSocketPacket{
-				Type: utils.TextMessage,
-				Data: jsonResponse,
+		if response.Type == "UtteranceEnd" {
+			s.events <- TranscriptEvent{UtteranceEnd: true}
+			continue
+		}
+
+		if response.Type == "Results" && len(response.Channel.Alternatives) > 0 {
+			end := response.Start + response.Duration
+			if replayedUntil == 0 || end > replayedUntil+deepgramReplayTolerance {
+				s.forward(response)
+			}
+			// Only the Finalize flush carries the tail of the utterance. Finals still pending
+			// when the stream was stopped come before it, and the read deadline bounds the wait.
+			if !response.FromFinalize {
+				continue
+			}
+			select {
+			case <-s.stop:
+				log.Println("Stop signal received")
+				return nil
+			default:
+				continue
 			}
 		}
 	}
+}
+
+// forward sends the transcripts of one Results message to the events channel
+func (s *deepgramStream) forward(response Response) {
+	if response.IsFinal {
+		s.mu.Lock()
+		s.finalEnd = response.Start + response.Duration
+		s.mu.Unlock()
+	}
+	for _, alternative := range response.Channel.Alternatives {
+		// An empty speech final result still marks the end of an utterance
+		if alternative.Transcript != "" || response.SpeechFinal {
+			log.Println("Transcript sent to channel:", alternative.Transcript)
+			text := alternative.Transcript
+			if text != "" {
+				text += " "
+			}
+			var words []utils.Word
+			for _, w := range alternative.Words {
+				word := utils.Word{Word: w.PunctuatedWord, Start: w.Start, End: w.End, Confidence: w.Confidence, Speaker: w.Speaker}
+				if word.Word == "" {
+					word.Word = w.Word
+				}
+				words = append(words, word)
+			}
+			s.events <- TranscriptEvent{
+				Text:        text, // Send the transcript through the channel
+				IsFinal:     response.IsFinal,
+				SpeechFinal: response.SpeechFinal,
+				Start:       response.Start,
+				Duration:    response.Duration,
+				Confidence:  alternative.Confidence,
+				Words:       words,
+			}
+		}
+	}
+}
+
+// Send transcript output back to the client in the right data shape
+// Receives a stream of text from input channel. Each final piece is sent
+// to the client as a transcript.final event with its words, and each hypothesis
+// as a transcript.interim event the client shows until the next one replaces it.
+// Then the final pieces are collected into a single full transcript
+// and this transcript is pushed into the output channel
+// Once ctx is cancelled nothing more goes to the client, but the input is still
+// drained so the STT stream can shut down.
+func SendTranscriptToClient(ctx context.Context, inputChannel <-chan TranscriptEvent, outputChannel chan Transcript, events *protocol.TurnWriter) {
+	var fullTranscript Transcript // Accumulate the transcript
+
+	for event := range inputChannel {
+		if ctx.Err() != nil || event.Text == "" {
+			continue
+		}
+		if !event.IsFinal {
+			// Only a preview, it stays out of the transcript sent to the LLM
+			events.SendText(ctx, protocol.TranscriptInterim, event.Text)
+			continue
+		}
+		log.Println("Transcript:", event.Text)
+		fullTranscript.Add(event)
+		SendFinalTranscript(ctx, event, events)
+	}
 
 	// After the loop ends, send the full transcript to the doneChan
 	log.Println("Sending final transcript to output")
@@ -160,49 +519,120 @@ func SendTranscriptToClient(inputChannel chan string, outputChannel chan string,
 	close(outputChannel) // Close the doneChan to signal completion
 }
 
+// SendFinalTranscript sends a final piece of transcript to the client
+func SendFinalTranscript(ctx context.Context, event TranscriptEvent, events *protocol.TurnWriter) error {
+	return events.Send(ctx, protocol.TranscriptFinal, protocol.TranscriptPayload{Text: event.Text, Words: event.Words})
+}
+
+const deepgramSpeakURL = "https://api.deepgram.com/v1/speak"
+
+// DeepgramTTS synthesizes speech with Deepgram Aura.
+// It returns mp3, Deepgram's default encoding for the speak endpoint.
+type DeepgramTTS struct {
+	APIKey string
+	Model  string // Aura voice, e.g. aura-helios-en
+	Client *http.Client
+}
+
+func NewDeepgramTTS(apiKey string) *DeepgramTTS {
+	return &DeepgramTTS{
+		APIKey: apiKey,
+		Model:  "aura-helios-en",
+		Client: &http.Client{},
+	}
+}
+
+func (d *DeepgramTTS) Format() AudioFormat {
+	return AudioFormat{MimeType: "audio/mpeg", Encoding: "mp3", SampleRate: 22050}
+}
+
 // Sends text in one big batch to deepgram API
-func SendToDeepgramTTS(text string, rateLimitTicker *time.Ticker, mu *sync.Mutex, outChan chan<- []byte) {
-	<-rateLimitTicker.C
-	mu.Lock() //Ensure only one API call at a time goes out
-	defer mu.Unlock()
-	url := "https://api.deepgram.com/v1/speak?model=aura-helios-en"
-
-	apiKey := os.Getenv("DEEPGRAM_API_KEY")
-	req, err := http.NewRequest("POST", url, strings.NewReader(text))
+func (d *DeepgramTTS) Synthesize(ctx context.Context, text string, opts TTSOptions, audioOut chan<- []byte) error {
+	model := d.Model
+	if opts.Voice != "" {
+		model = opts.Voice
+	}
+	speakURL := deepgramSpeakURL + "?model=" + url.QueryEscape(model)
+	req, err := http.NewRequestWithContext(ctx, "POST", speakURL, strings.NewReader(text))
 	if err != nil {
-		return
+		return err
 	}
-	req.Header.Set("Authorization", "Token "+apiKey)
+	req.Header.Set("Authorization", "Token "+d.APIKey)
 	req.Header.Set("Content-Type", "text/plain")
 
-	client := &http.Client{}
 	log.Println("Sending text to deepgram TTS:", text)
-	resp, err := client.Do(req)
+	resp, err := d.Client.Do(req)
 	if err != nil {
-		return
+		return newUnavailableError("Deepgram", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Println("Deepgram API returned status:", resp.Status)
-		return
+		body, _ := io.ReadAll(resp.Body)
+		return newStatusError("Deepgram", resp.StatusCode, string(body))
 	}
 
-	audioData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return
+	// Pass the audio on as it's synthesized rather than waiting for the whole sentence
+	received := 0
+	for {
+		chunk := make([]byte, ttsChunkSize)
+		n, err := io.ReadFull(resp.Body, chunk)
+		if n > 0 {
+			received += n
+			select {
+			case audioOut <- chunk[:n]:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return newUnavailableError("Deepgram", err)
+		}
 	}
-	log.Printf("Successfully received %d bytes of audio from deepgram", len(audioData))
-	outChan <- audioData
-
+	log.Printf("Successfully received %d bytes of audio from deepgram", received)
+	return nil
 }
 
-func SendAudioToClient(inputChannel chan []byte, writeChan chan<- utils.WebSocketPacket) {
-	for audio := range inputChannel {
-		log.Printf("Sending %d bytes of audio to client", len(audio))
-		writeChan <- utils.WebSocketPacket{
-			Type: utils.BinaryMessage,
-			Data: audio,
+// Sends each chunk of bot audio to the client as a bot.audio.chunk event,
+// and a bot.audio.end event once a sentence is over.
+// Returns the audio that was sent, one slice per sentence. A sentence that was cut off is cut off there too.
+func SendAudioToClient(ctx context.Context, inputChannel chan SentenceChunk, format AudioFormat, events *protocol.TurnWriter) [][]byte {
+	var sent [][]byte
+	var sentence []byte // what has been sent of the current sentence
+	endSentence := func() {
+		if len(sentence) > 0 {
+			sent = append(sent, sentence)
+		}
+		sentence = nil
+	}
+	for chunk := range inputChannel {
+		var err error
+		if chunk.Last {
+			err = events.Send(ctx, protocol.BotAudioEnd, protocol.AudioEndPayload{Sentence: chunk.Seq, Chunks: chunk.Index})
+		} else {
+			log.Printf("Sending %d bytes of audio to client", len(chunk.Audio))
+			err = events.Send(ctx, protocol.BotAudioChunk, protocol.AudioChunkPayload{
+				MimeType: format.MimeType,
+				Data:     chunk.Audio,
+				Sentence: chunk.Seq,
+				Chunk:    chunk.Index,
+			})
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Error sending audio to client:", err)
+			}
+			break
+		}
+		if chunk.Last {
+			endSentence()
+		} else {
+			sentence = append(sentence, chunk.Audio...)
 		}
 	}
+	endSentence()
+	return sent
 }
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"go-websocket-server/config"
+	"go-websocket-server/protocol"
+	"go-websocket-server/utils"
+	"strings"
+	"time"
+)
+
+// TranscriptEvent is a piece of transcript coming back from an STT engine.
+// Engines that only return finished text send every event with IsFinal set.
+// An event that isn't final is a hypothesis for the segment being spoken:
+// the next event for that segment replaces it.
+type TranscriptEvent struct {
+	Text         string
+	IsFinal      bool // the text of this segment won't change anymore
+	SpeechFinal  bool // the engine heard a pause long enough to end the utterance
+	UtteranceEnd bool // no text, the engine saw no new words for a while
+
+	// Where the segment sits in the audio sent so far, in seconds, and how sure the engine is of it.
+	// Zero when the engine doesn't say.
+	Start      float64
+	Duration   float64
+	Confidence float64
+	Words      []utils.Word // nil when the engine doesn't give word timings
+}
+
+// Transcript is what the user said in a turn, put together from the final events
+type Transcript struct {
+	Text  string
+	Words []utils.Word
+	Audio *utils.Recording // what the user said as audio, nil unless the server records it
+}
+
+// Add appends a final event to the transcript
+func (t *Transcript) Add(event TranscriptEvent) {
+	t.Text += event.Text
+	t.Words = append(t.Words, event.Words...)
+}
+
+// Segment is a stretch of a transcript said by one speaker
+type Segment struct {
+	Transcript
+	Speaker *int // nil when the engine doesn't tell speakers apart
+}
+
+// Name is who the segment is saved as: speaker_N when diarized, user otherwise
+func (s Segment) Name() string {
+	if s.Speaker == nil {
+		return "user"
+	}
+	return fmt.Sprintf("speaker_%d", *s.Speaker)
+}
+
+// Segments splits the transcript wherever the speaker changes.
+// Without speakers, e.g. typed messages or diarization off, it's one segment with the whole transcript.
+func (t Transcript) Segments() []Segment {
+	diarized := false
+	for _, word := range t.Words {
+		if word.Speaker != nil {
+			diarized = true
+			break
+		}
+	}
+	if !diarized {
+		return []Segment{{Transcript: t}}
+	}
+
+	var segments []Segment
+	var texts [][]string
+	for _, word := range t.Words {
+		last := len(segments) - 1
+		if last < 0 || !sameSpeaker(segments[last].Speaker, word.Speaker) {
+			segments = append(segments, Segment{Speaker: word.Speaker})
+			texts = append(texts, nil)
+			last++
+		}
+		segments[last].Words = append(segments[last].Words, word)
+		texts[last] = append(texts[last], word.Word)
+	}
+	for i := range segments {
+		segments[i].Text = strings.Join(texts[i], " ")
+	}
+	return segments
+}
+
+func sameSpeaker(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// STTOptions tunes a stream. The zero value is a plain push-to-talk stream.
+type STTOptions struct {
+	// InterimResults asks for hypotheses while the user is still talking,
+	// on top of the final transcript. Hands-free streams always get them.
+	InterimResults bool
+
+	// Listen overrides the provider's default recognition settings (model, language...)
+	Listen protocol.ListenOptions
+
+	// Prewarm connects to the engine right away instead of on the first audio,
+	// so the user's first words don't wait for the handshake
+	Prewarm bool
+
+	// Endpointing and UtteranceEnd turn on end-of-speech detection for hands-free mode:
+	// the silence after which a segment is speech final, and the gap between words
+	// after which an UtteranceEnd event is sent. Zero leaves them off.
+	Endpointing  time.Duration
+	UtteranceEnd time.Duration
+}
+
+// HandsFree reports whether the stream has to detect the end of speech by itself
+func (o STTOptions) HandsFree() bool {
+	return o.Endpointing > 0 || o.UtteranceEnd > 0
+}
+
+// STTProvider opens speech-to-text streams.
+// In push-to-talk mode every user turn gets its own stream,
+// in hands-free mode one stream lasts as long as the mode is on.
+type STTProvider interface {
+	OpenStream(ctx context.Context, opts STTOptions) (STTStream, error)
+	// ValidateListen checks listen options before any stream is opened with them
+	ValidateListen(listen protocol.ListenOptions) error
+}
+
+// STTStream is a single speech-to-text session.
+// Audio is pushed in with SendAudio as it arrives from the client.
+// Finalize tells the engine that the user has stopped talking; the engine then flushes
+// whatever it has left into Events and closes the channel.
+// Close tears the stream down without waiting for any more transcripts.
+type STTStream interface {
+	SendAudio(audio []byte) error
+	Finalize() error
+	Events() <-chan TranscriptEvent
+	Close() error
+}
+
+// NewSTTProvider builds the speech-to-text backend chosen in cfg.Provider.
+// "deepgram" streams to Deepgram's listen websocket,
+// "local" runs cfg.LocalCommand for every turn (see LocalSTT).
+func NewSTTProvider(cfg config.STTConfig, deepgram config.DeepgramConfig) (STTProvider, error) {
+	switch cfg.Provider {
+	case "deepgram":
+		provider := NewDeepgramSTT(deepgram.APIKey)
+		provider.Listen = protocol.ListenOptions{
+			Model:       cfg.Model,
+			Language:    cfg.Language,
+			SmartFormat: onlyIfTrue(cfg.SmartFormat),
+			Punctuate:   onlyIfTrue(cfg.Punctuate),
+			Diarize:     onlyIfTrue(cfg.Diarize),
+			Encoding:    cfg.Encoding,
+			SampleRate:  cfg.SampleRate,
+		}
+		for _, keyword := range strings.Split(cfg.Keywords, ",") {
+			if keyword = strings.TrimSpace(keyword); keyword != "" {
+				provider.Listen.Keywords = append(provider.Listen.Keywords, keyword)
+			}
+		}
+		if err := validateDeepgramListen(provider.Listen); err != nil {
+			return nil, fmt.Errorf("invalid Deepgram listen settings: %w", err)
+		}
+		return provider, nil
+	case "local":
+		command := strings.Fields(cfg.LocalCommand)
+		if len(command) == 0 {
+			return nil, fmt.Errorf("a command is required for the local STT provider")
+		}
+		return &LocalSTT{Command: command[0], Args: command[1:]}, nil
+	default:
+		return nil, fmt.Errorf("unknown STT provider %q", cfg.Provider)
+	}
+}
+
+// onlyIfTrue leaves switches that are off unset, so Deepgram's own defaults apply
+func onlyIfTrue(b bool) *bool {
+	if !b {
+		return nil
+	}
+	return &b
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go-websocket-server/protocol"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// LocalSTT runs an offline speech-to-text engine as a subprocess, one process per turn.
+// The command receives the raw client audio on stdin and must print the transcript
+// on stdout, one segment per line, once stdin is closed.
+// whisper.cpp can be plugged in this way with a small wrapper script,
+// see scripts/whisper-stt.sh.
+type LocalSTT struct {
+	Command string
+	Args    []string
+}
+
+// ValidateListen refuses every option, the engine is configured by its own command line
+func (l *LocalSTT) ValidateListen(listen protocol.ListenOptions) error {
+	if !listen.IsZero() {
+		return &ProviderError{Kind: ErrBadInput, Provider: "the local STT engine", Err: fmt.Errorf("listen options are not supported")}
+	}
+	return nil
+}
+
+type localSTTStream struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	events chan TranscriptEvent
+
+	closeOnce sync.Once
+}
+
+func (l *LocalSTT) OpenStream(ctx context.Context, opts STTOptions) (STTStream, error) {
+	if opts.HandsFree() {
+		// The engine only transcribes once stdin is closed, so it can't hear the user stop talking
+		return nil, &ProviderError{Kind: ErrBadInput, Provider: "the local STT engine", Err: fmt.Errorf("hands-free mode needs a streaming STT engine")}
+	}
+	cmd := exec.CommandContext(ctx, l.Command, l.Args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdin of %s: %w", l.Command, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdout of %s: %w", l.Command, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, newUnavailableError("the local STT engine", fmt.Errorf("failed to start %s: %w", l.Command, err))
+	}
+	log.Printf("Started local STT engine %s", l.Command)
+
+	s := &localSTTStream{
+		cmd:    cmd,
+		stdin:  stdin,
+		events: make(chan TranscriptEvent),
+	}
+	go s.readTranscripts(stdout)
+	return s, nil
+}
+
+// readTranscripts forwards every non-empty line the engine prints as a transcript
+func (s *localSTTStream) readTranscripts(stdout io.Reader) {
+	defer close(s.events)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		log.Println("Transcript from local STT:", line)
+		s.events <- TranscriptEvent{Text: line + " ", IsFinal: true}
+	}
+	if err := s.cmd.Wait(); err != nil {
+		log.Printf("Local STT engine exited with error: %v", err)
+	}
+}
+
+func (s *localSTTStream) SendAudio(audio []byte) error {
+	if _, err := s.stdin.Write(audio); err != nil {
+		return newUnavailableError("the local STT engine", err)
+	}
+	return nil
+}
+
+// Finalize closes the engine's stdin so it starts transcribing
+func (s *localSTTStream) Finalize() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.stdin.Close()
+	})
+	return err
+}
+
+func (s *localSTTStream) Events() <-chan TranscriptEvent {
+	return s.events
+}
+
+func (s *localSTTStream) Close() error {
+	s.Finalize()
+	if s.cmd.Process == nil {
+		return nil
+	}
+	return s.cmd.Process.Kill()
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go-websocket-server/config"
+	"go-websocket-server/utils"
+	"strings"
+)
+
+// AudioFormat describes the audio a TTS engine produces
+type AudioFormat struct {
+	MimeType   string `json:"mimeType"`   // e.g. audio/mpeg, what the browser needs to play it
+	Encoding   string `json:"encoding"`   // e.g. mp3, linear16
+	SampleRate int    `json:"sampleRate"` // in Hz, 0 if the engine decides
+}
+
+// TTSProvider turns text into audio.
+// Synthesize pushes the audio for text into audioOut in one or more chunks
+// and returns once the whole text has been synthesized.
+// It must not close audioOut, the caller owns that channel.
+type TTSProvider interface {
+	Format() AudioFormat
+	Synthesize(ctx context.Context, text string, opts TTSOptions, audioOut chan<- []byte) error
+}
+
+// TTSOptions tune the synthesis of a single sentence, e.g. for the conversation's persona.
+// Unset fields keep the provider's defaults.
+type TTSOptions struct {
+	Voice string // engines without voices to pick from ignore it
+}
+
+// Size of the audio chunks passed on while a sentence is synthesized, under a second of Deepgram's mp3.
+// Engines and the cache that have the whole sentence at once split it the same way,
+// so clients get the same chunks wherever the audio came from.
+const ttsChunkSize = 4 << 10
+
+// sendInChunks passes a whole sentence's audio on in chunks of ttsChunkSize
+func sendInChunks(ctx context.Context, audio []byte, audioOut chan<- []byte) error {
+	for len(audio) > 0 {
+		n := min(len(audio), ttsChunkSize)
+		select {
+		case audioOut <- audio[:n]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		audio = audio[n:]
+	}
+	return nil
+}
+
+// SaveReplyAudio stores the audio of a bot reply, its sentences joined into one file
+func SaveReplyAudio(conversationID string, messageIndex int, format AudioFormat, sentences [][]byte) error {
+	audio := bytes.Join(sentences, nil)
+	// Every sentence is a complete WAV file, they need merging rather than stringing together
+	if format.MimeType == "audio/wav" {
+		if joined, ok := utils.JoinWav(sentences); ok {
+			audio = joined
+		}
+	}
+	return utils.SaveMessageAudio(conversationID, messageIndex, format.MimeType, audio)
+}
+
+// NewTTSProvider builds the text-to-speech backend chosen in cfg.Provider.
+// "deepgram" uses Deepgram Aura with cfg.Voice,
+// "local" runs cfg.LocalCommand for every sentence (see LocalTTS),
+// and "fake" generates a beep per sentence so the voice loop can run offline.
+// With cfg.Cache set, the backend sits behind a CachedTTS. The sqlite cache needs the database initialized.
+// With a lexicon, everything sits behind a LexiconTTS.
+func NewTTSProvider(cfg config.TTSConfig, deepgram config.DeepgramConfig, lexicon *utils.Lexicon) (TTSProvider, error) {
+	var provider TTSProvider
+	var engine string // what the cache needs to tell engines and voices apart
+	switch cfg.Provider {
+	case "deepgram":
+		deepgramTTS := NewDeepgramTTS(deepgram.APIKey)
+		deepgramTTS.Model = cfg.Voice
+		provider, engine = deepgramTTS, "deepgram/"+cfg.Voice
+	case "local":
+		command := strings.Fields(cfg.LocalCommand)
+		if len(command) == 0 {
+			return nil, fmt.Errorf("a command is required for the local TTS provider")
+		}
+		format := AudioFormat{MimeType: cfg.LocalMimeType, Encoding: "linear16"}
+		provider = &LocalTTS{Command: command[0], Args: command[1:], AudioFormat: format}
+		engine = "local/" + strings.Join(command, " ")
+	case "fake":
+		provider, engine = NewFakeTTS(), "fake"
+	default:
+		return nil, fmt.Errorf("unknown TTS provider %q", cfg.Provider)
+	}
+
+	provider, err := withCache(provider, engine, cfg)
+	if err != nil || lexicon == nil {
+		return provider, err
+	}
+	return &LexiconTTS{TTSProvider: provider, Lexicon: lexicon, SSML: cfg.SSML}, nil
+}
+
+// withCache puts provider behind the cache chosen in cfg.Cache, if any
+func withCache(provider TTSProvider, engine string, cfg config.TTSConfig) (TTSProvider, error) {
+	maxBytes := int64(cfg.CacheMaxMB) << 20
+	var cache *utils.BlobCache
+	var err error
+	switch cfg.Cache {
+	case "", "off":
+		return provider, nil
+	case "disk":
+		cache, err = utils.NewDiskBlobCache(cfg.CacheDir, maxBytes)
+	case "sqlite":
+		cache, err = utils.NewSQLiteBlobCache(maxBytes)
+	default:
+		return nil, fmt.Errorf("unknown TTS cache %q", cfg.Cache)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the TTS cache: %w", err)
+	}
+	return &CachedTTS{TTSProvider: provider, Cache: cache, Engine: engine}, nil
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go-websocket-server/utils"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CachedTTS answers sentences that were synthesized before from a cache instead of the engine.
+// Entries are content addressed: the key is a hash of the engine, the voice, the audio format and the text,
+// so anything that would change the audio gets a new entry.
+type CachedTTS struct {
+	TTSProvider
+	Cache  *utils.BlobCache
+	Engine string // the engine and its voice, e.g. deepgram/aura-helios-en
+}
+
+// key hashes everything the audio for text depends on.
+// Only whitespace is normalized, anything else can change how the text is spoken.
+func (c *CachedTTS) key(text string, opts TTSOptions) string {
+	format := c.Format()
+	parts := []string{c.Engine, format.MimeType, format.Encoding, strconv.Itoa(format.SampleRate), strings.Join(strings.Fields(text), " ")}
+	// Only when set, so entries made with the default voice stay valid
+	if opts.Voice != "" {
+		parts = append(parts, "voice="+opts.Voice)
+	}
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (c *CachedTTS) Synthesize(ctx context.Context, text string, opts TTSOptions, audioOut chan<- []byte) error {
+	key := c.key(text, opts)
+	audio, ok, err := c.Cache.Get(key)
+	if err != nil {
+		log.Printf("Failed to read the TTS cache: %v", err)
+	}
+	if ok {
+		log.Printf("TTS cache hit for %q", text)
+		return sendInChunks(ctx, audio, audioOut)
+	}
+
+	// Pass the engine's audio on as it comes, and keep a copy for the cache
+	chunks := make(chan []byte)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.TTSProvider.Synthesize(ctx, text, opts, chunks)
+		close(chunks)
+	}()
+	var synthesized bytes.Buffer
+	for chunk := range chunks {
+		synthesized.Write(chunk)
+		select {
+		case audioOut <- chunk:
+		case <-ctx.Done():
+		}
+	}
+	if err := <-errChan; err != nil {
+		return err
+	}
+	// Half a sentence is no good to anyone
+	if ctx.Err() != nil || synthesized.Len() == 0 {
+		return ctx.Err()
+	}
+	if err := c.Cache.Put(key, synthesized.Bytes()); err != nil {
+		log.Printf("Failed to write to the TTS cache: %v", err)
+	}
+	return nil
+}
+
+// StatsHandler serves the cache's hit, miss and size counters as JSON
+func (c *CachedTTS) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Cache.Stats())
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"go-websocket-server/utils"
+	"math"
+	"strings"
+	"time"
+)
+
+// FakeTTS answers every sentence with a sine beep, a bit longer for longer sentences.
+// It lets the whole voice loop run in tests or without a TTS account.
+type FakeTTS struct {
+	SampleRate  int
+	Frequency   float64       // pitch of the beep in Hz
+	PerWord     time.Duration // beep length per word of text
+	MaxDuration time.Duration
+}
+
+func NewFakeTTS() *FakeTTS {
+	return &FakeTTS{
+		SampleRate:  16000,
+		Frequency:   440,
+		PerWord:     150 * time.Millisecond,
+		MaxDuration: 3 * time.Second,
+	}
+}
+
+func (f *FakeTTS) Format() AudioFormat {
+	return AudioFormat{MimeType: "audio/wav", Encoding: "linear16", SampleRate: f.SampleRate}
+}
+
+func (f *FakeTTS) Synthesize(ctx context.Context, text string, opts TTSOptions, audioOut chan<- []byte) error {
+	duration := time.Duration(len(strings.Fields(text))) * f.PerWord
+	if duration > f.MaxDuration {
+		duration = f.MaxDuration
+	}
+	numSamples := int(duration.Seconds() * float64(f.SampleRate))
+
+	samples := make([]byte, numSamples*2)
+	for i := 0; i < numSamples; i++ {
+		t := float64(i) / float64(f.SampleRate)
+		value := int16(math.Sin(2*math.Pi*f.Frequency*t) * math.MaxInt16 / 4)
+		binary.LittleEndian.PutUint16(samples[i*2:], uint16(value))
+	}
+
+	audio := append(utils.WavHeader(f.SampleRate, 1, 16, len(samples)), samples...)
+	return sendInChunks(ctx, audio, audioOut)
+}
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"context"
+	"go-websocket-server/utils"
+)
+
+// LexiconTTS applies the deployment's pronunciation lexicon to every sentence before its engine synthesizes it.
+// With SSML, the engine gets SSML with phoneme tags, otherwise plain text with words respelled.
+// It sits in front of the cache, so changing the lexicon doesn't replay stale audio.
+type LexiconTTS struct {
+	TTSProvider
+	Lexicon *utils.Lexicon
+	SSML    bool // the engine reads SSML, e.g. espeak-ng -m
+}
+
+func (l *LexiconTTS) Synthesize(ctx context.Context, text string, opts TTSOptions, audioOut chan<- []byte) error {
+	return l.TTSProvider.Synthesize(ctx, l.Lexicon.Apply(text, l.SSML), opts, audioOut)
+}
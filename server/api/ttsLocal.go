@@ -0,0 +1,41 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// LocalTTS runs an offline TTS engine as a subprocess, one process per sentence.
+// The command gets the text on stdin and must write a complete audio file to stdout.
+// For example:
+//
+//	espeak-ng --stdin --stdout
+//	piper --model en_US-lessac-medium.onnx --output_file /dev/stdout
+type LocalTTS struct {
+	Command     string
+	Args        []string
+	AudioFormat AudioFormat
+}
+
+func (l *LocalTTS) Format() AudioFormat {
+	return l.AudioFormat
+}
+
+func (l *LocalTTS) Synthesize(ctx context.Context, text string, opts TTSOptions, audioOut chan<- []byte) error {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, l.Command, l.Args...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.Println("Sending text to local TTS:", text)
+	if err := cmd.Run(); err != nil {
+		return newUnavailableError("the local TTS engine", fmt.Errorf("%s failed: %w: %s", l.Command, err, stderr.String()))
+	}
+	log.Printf("Successfully received %d bytes of audio from %s", stdout.Len(), l.Command)
+	return sendInChunks(ctx, stdout.Bytes(), audioOut)
+}
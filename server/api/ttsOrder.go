@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"log"
+)
+
+// SentenceChunk is a piece of the synthesized audio for one sentence of a bot reply.
+// Seq is the sentence's position in the reply, starting at 0, and Index the chunk's position in the sentence.
+// Every sentence ends with a Last chunk that has no audio, even when synthesis failed.
+type SentenceChunk struct {
+	Seq   int
+	Index int
+	Audio []byte
+	Last  bool
+}
+
+// ReorderAudio forwards sentence chunks to audioOut in sequence order.
+// Chunks of the sentence being played go straight through as they arrive,
+// chunks of a later sentence are held back until every sentence before it has ended.
+// Returns once inputChannel is closed and everything in order has been flushed,
+// or as soon as ctx is cancelled.
+func ReorderAudio(ctx context.Context, inputChannel <-chan SentenceChunk, audioOut chan<- SentenceChunk) {
+	next := 0
+	pending := make(map[int][]SentenceChunk)
+	forward := func(chunk SentenceChunk) bool {
+		select {
+		case audioOut <- chunk:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for chunk := range inputChannel {
+		if chunk.Seq != next {
+			pending[chunk.Seq] = append(pending[chunk.Seq], chunk)
+			continue
+		}
+		if !forward(chunk) {
+			return
+		}
+		// Once a sentence is over, catch up on whatever the next ones already have
+		for chunk.Last {
+			next++
+			held := pending[next]
+			delete(pending, next)
+			chunk = SentenceChunk{}
+			for _, chunk = range held {
+				if !forward(chunk) {
+					return
+				}
+			}
+		}
+	}
+	if len(pending) > 0 {
+		log.Printf("Dropping audio for %d sentences that never got their turn", len(pending))
+	}
+}
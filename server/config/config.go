@@ -0,0 +1,434 @@
+// Package config holds every setting of the server in one typed struct.
+// It is loaded once at startup and passed down to whatever needs it.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Server   ServerConfig
+	DB       DBConfig
+	History  HistoryConfig
+	LLM      LLMConfig
+	STT      STTConfig
+	TTS      TTSConfig
+	Record   RecordConfig
+	Debate   DebateConfig
+	Admin    AdminConfig
+	Groq     GroqConfig
+	Deepgram DeepgramConfig
+}
+
+type ServerConfig struct {
+	Addr string // address to listen on, e.g. :8080
+}
+
+type DBConfig struct {
+	Path string // SQLite file
+}
+
+type HistoryConfig struct {
+	Window int // how many past messages are sent to the LLM with each turn
+}
+
+type LLMConfig struct {
+	Provider string // groq, openai or fake
+	BaseURL  string // for openai, e.g. http://localhost:11434/v1
+	Model    string // empty means the provider's default
+	APIKey   string // for groq this falls back to groq.api_key
+}
+
+type STTConfig struct {
+	Provider     string        // deepgram or local
+	LocalCommand string        // for local, the engine's command line
+	Connect      string        // lazy: open a turn's STT stream on its first audio, eager: as soon as the turn starts
+	Endpointing  time.Duration // hands-free: silence that ends a spoken segment
+	UtteranceEnd time.Duration // hands-free: gap between words that ends the user's turn
+
+	// Default recognition settings for deepgram, clients can override them in session.start
+	Model       string // e.g. nova-2, empty means Deepgram's default
+	Language    string // e.g. en-US
+	SmartFormat bool
+	Punctuate   bool
+	Diarize     bool
+	Keywords    string // comma separated, e.g. "Groq:2,Deepgram"
+	Encoding    string // only for raw audio, e.g. linear16
+	SampleRate  int    // in Hz, required with Encoding
+}
+
+type TTSConfig struct {
+	Provider      string        // deepgram, local or fake
+	Voice         string        // Deepgram Aura voice
+	LocalCommand  string        // for local, the engine's command line
+	LocalMimeType string        // for local, the MIME type of the audio the engine writes
+	RateLimit     time.Duration // minimum gap between the start of two TTS requests
+	SaveAudio     bool          // keep the audio of every reply so clients can replay it
+	Cache         string        // where synthesized sentences are cached: off, disk or sqlite
+	CacheDir      string        // for disk
+	CacheMaxMB    int           // the cache drops its least recently used sentences past this size
+	ChunkMin      int           // shorter sentences are sent to TTS together with the next one
+	ChunkMax      int           // longer sentences are cut at a clause break, 0 for no limit
+	EagerFirst    bool          // send the reply's first clause to TTS without waiting for the full sentence
+	Normalize     bool          // rewrite markdown, numbers, dates and such the way they're spoken before TTS
+	SpellOut      string        // comma separated acronyms read letter by letter, e.g. "API,SQL"
+	SSML          bool          // the engine reads SSML, so the lexicon can give it phonemes
+}
+
+type RecordConfig struct {
+	Enabled bool   // save the raw audio of every spoken user message
+	Dir     string // where recordings go, one folder per conversation
+}
+
+// DebateConfig is how long each phase of a debate lasts
+type DebateConfig struct {
+	Opening          time.Duration
+	Rebuttal         time.Duration
+	CrossExamination time.Duration
+	Closing          time.Duration
+}
+
+type AdminConfig struct {
+	Token string // bearer token for the /admin endpoints, which are off without one
+}
+
+type GroqConfig struct {
+	APIKey string
+}
+
+type DeepgramConfig struct {
+	APIKey string
+}
+
+// Default returns the settings the server runs with when nothing is configured
+func Default() *Config {
+	return &Config{
+		Server:  ServerConfig{Addr: ":8080"},
+		DB:      DBConfig{Path: "./conversation.db"},
+		History: HistoryConfig{Window: 6},
+		LLM:     LLMConfig{Provider: "groq"},
+		STT: STTConfig{
+			Provider:     "deepgram",
+			Connect:      "lazy",
+			Endpointing:  500 * time.Millisecond,
+			UtteranceEnd: time.Second,
+		},
+		TTS: TTSConfig{
+			Provider:      "deepgram",
+			Voice:         "aura-helios-en",
+			LocalMimeType: "audio/wav",
+			RateLimit:     time.Second,
+			Cache:         "off",
+			CacheDir:      "./tts-cache",
+			CacheMaxMB:    100,
+			ChunkMin:      20,
+			ChunkMax:      250,
+			EagerFirst:    true,
+			Normalize:     true,
+			SpellOut:      "AI,API,CPU,GPU,HTML,CSS,LLM,SQL,STT,TTS,UI,URL,USB",
+		},
+		Record: RecordConfig{Dir: "./recordings"},
+		Debate: DebateConfig{
+			Opening:          2 * time.Minute,
+			Rebuttal:         2 * time.Minute,
+			CrossExamination: 3 * time.Minute,
+			Closing:          time.Minute,
+		},
+	}
+}
+
+// setting ties one field of Config to its name in the config file,
+// its environment variable and its command-line flag.
+// The flag name is the file key with dots and underscores turned into dashes.
+type setting struct {
+	key   string // e.g. llm.base_url
+	env   string // e.g. LLM_BASE_URL
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func (s setting) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+func stringSetting(key, env, usage string, field func(c *Config) *string) setting {
+	return setting{key, env, usage, func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func intSetting(key, env, usage string, field func(c *Config) *int) setting {
+	return setting{key, env, usage, func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a whole number, got %q", key, value)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func boolSetting(key, env, usage string, field func(c *Config) *bool) setting {
+	return setting{key, env, usage, func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, got %q", key, value)
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func durationSetting(key, env, usage string, field func(c *Config) *time.Duration) setting {
+	return setting{key, env, usage, func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 500ms or 1s, got %q", key, value)
+		}
+		*field(c) = d
+		return nil
+	}}
+}
+
+var settings = []setting{
+	stringSetting("server.addr", "SERVER_ADDR", "address to listen on", func(c *Config) *string { return &c.Server.Addr }),
+	stringSetting("db.path", "DB_PATH", "path of the SQLite database", func(c *Config) *string { return &c.DB.Path }),
+	intSetting("history.window", "HISTORY_WINDOW", "number of past messages sent to the LLM", func(c *Config) *int { return &c.History.Window }),
+	stringSetting("llm.provider", "LLM_PROVIDER", "LLM backend: groq, openai or fake", func(c *Config) *string { return &c.LLM.Provider }),
+	stringSetting("llm.base_url", "LLM_BASE_URL", "base URL of an OpenAI-compatible server", func(c *Config) *string { return &c.LLM.BaseURL }),
+	stringSetting("llm.model", "LLM_MODEL", "LLM model name", func(c *Config) *string { return &c.LLM.Model }),
+	stringSetting("llm.api_key", "LLM_API_KEY", "API key for the LLM server", func(c *Config) *string { return &c.LLM.APIKey }),
+	stringSetting("stt.provider", "STT_PROVIDER", "STT backend: deepgram or local", func(c *Config) *string { return &c.STT.Provider }),
+	stringSetting("stt.local_cmd", "STT_LOCAL_CMD", "command line of the local STT engine", func(c *Config) *string { return &c.STT.LocalCommand }),
+	stringSetting("stt.connect", "STT_CONNECT", "when to open a turn's STT stream: lazy or eager", func(c *Config) *string { return &c.STT.Connect }),
+	durationSetting("stt.endpointing", "STT_ENDPOINTING", "hands-free: silence that ends a spoken segment", func(c *Config) *time.Duration { return &c.STT.Endpointing }),
+	durationSetting("stt.utterance_end", "STT_UTTERANCE_END", "hands-free: gap between words that ends the user's turn", func(c *Config) *time.Duration { return &c.STT.UtteranceEnd }),
+	stringSetting("stt.model", "STT_MODEL", "Deepgram model, e.g. nova-2", func(c *Config) *string { return &c.STT.Model }),
+	stringSetting("stt.language", "STT_LANGUAGE", "language of the user's speech, e.g. en-US", func(c *Config) *string { return &c.STT.Language }),
+	boolSetting("stt.smart_format", "STT_SMART_FORMAT", "format numbers, dates and punctuation in transcripts", func(c *Config) *bool { return &c.STT.SmartFormat }),
+	boolSetting("stt.punctuate", "STT_PUNCTUATE", "add punctuation and capitalization to transcripts", func(c *Config) *bool { return &c.STT.Punctuate }),
+	boolSetting("stt.diarize", "STT_DIARIZE", "tell speakers apart", func(c *Config) *bool { return &c.STT.Diarize }),
+	stringSetting("stt.keywords", "STT_KEYWORDS", "comma-separated words to boost", func(c *Config) *string { return &c.STT.Keywords }),
+	stringSetting("stt.encoding", "STT_ENCODING", "encoding of raw client audio, e.g. linear16", func(c *Config) *string { return &c.STT.Encoding }),
+	intSetting("stt.sample_rate", "STT_SAMPLE_RATE", "sample rate of raw client audio", func(c *Config) *int { return &c.STT.SampleRate }),
+	stringSetting("tts.provider", "TTS_PROVIDER", "TTS backend: deepgram, local or fake", func(c *Config) *string { return &c.TTS.Provider }),
+	stringSetting("tts.voice", "TTS_VOICE", "Deepgram Aura voice", func(c *Config) *string { return &c.TTS.Voice }),
+	stringSetting("tts.local_cmd", "TTS_LOCAL_CMD", "command line of the local TTS engine", func(c *Config) *string { return &c.TTS.LocalCommand }),
+	stringSetting("tts.local_mime_type", "TTS_LOCAL_MIME_TYPE", "MIME type of the local TTS engine's audio", func(c *Config) *string { return &c.TTS.LocalMimeType }),
+	durationSetting("tts.rate_limit", "TTS_RATE_LIMIT", "minimum gap between TTS requests", func(c *Config) *time.Duration { return &c.TTS.RateLimit }),
+	boolSetting("tts.save_audio", "TTS_SAVE_AUDIO", "keep the audio of bot replies for replay", func(c *Config) *bool { return &c.TTS.SaveAudio }),
+	stringSetting("tts.cache", "TTS_CACHE", "cache synthesized sentences: off, disk or sqlite", func(c *Config) *string { return &c.TTS.Cache }),
+	stringSetting("tts.cache_dir", "TTS_CACHE_DIR", "directory of the disk TTS cache", func(c *Config) *string { return &c.TTS.CacheDir }),
+	intSetting("tts.cache_max_mb", "TTS_CACHE_MAX_MB", "size limit of the TTS cache in MB", func(c *Config) *int { return &c.TTS.CacheMaxMB }),
+	intSetting("tts.chunk_min_length", "TTS_CHUNK_MIN_LENGTH", "shortest chunk of text sent to TTS, in characters", func(c *Config) *int { return &c.TTS.ChunkMin }),
+	intSetting("tts.chunk_max_length", "TTS_CHUNK_MAX_LENGTH", "longest chunk of text sent to TTS, in characters (0 for no limit)", func(c *Config) *int { return &c.TTS.ChunkMax }),
+	boolSetting("tts.eager_first", "TTS_EAGER_FIRST", "send the first clause of a reply to TTS right away", func(c *Config) *bool { return &c.TTS.EagerFirst }),
+	boolSetting("tts.normalize", "TTS_NORMALIZE", "rewrite markdown, numbers and such for speech before TTS", func(c *Config) *bool { return &c.TTS.Normalize }),
+	stringSetting("tts.spell_out", "TTS_SPELL_OUT", "comma-separated acronyms to read letter by letter", func(c *Config) *string { return &c.TTS.SpellOut }),
+	boolSetting("tts.ssml", "TTS_SSML", "the local TTS engine reads SSML", func(c *Config) *bool { return &c.TTS.SSML }),
+	boolSetting("record.enabled", "RECORD_ENABLED", "save the raw audio of spoken user messages", func(c *Config) *bool { return &c.Record.Enabled }),
+	stringSetting("record.dir", "RECORD_DIR", "directory for recorded user audio", func(c *Config) *string { return &c.Record.Dir }),
+	durationSetting("debate.opening", "DEBATE_OPENING", "length of a debate's opening statements", func(c *Config) *time.Duration { return &c.Debate.Opening }),
+	durationSetting("debate.rebuttal", "DEBATE_REBUTTAL", "length of a debate's rebuttal", func(c *Config) *time.Duration { return &c.Debate.Rebuttal }),
+	durationSetting("debate.cross_examination", "DEBATE_CROSS_EXAMINATION", "length of a debate's cross-examination", func(c *Config) *time.Duration { return &c.Debate.CrossExamination }),
+	durationSetting("debate.closing", "DEBATE_CLOSING", "length of a debate's closing statements", func(c *Config) *time.Duration { return &c.Debate.Closing }),
+	stringSetting("admin.token", "ADMIN_TOKEN", "bearer token for the admin endpoints", func(c *Config) *string { return &c.Admin.Token }),
+	stringSetting("groq.api_key", "GROQ_API_KEY", "Groq API key", func(c *Config) *string { return &c.Groq.APIKey }),
+	stringSetting("deepgram.api_key", "DEEPGRAM_API_KEY", "Deepgram API key", func(c *Config) *string { return &c.Deepgram.APIKey }),
+}
+
+// Load builds the config from, in increasing order of priority:
+// the defaults, the config file (-config flag or CONFIG_FILE), environment variables and command-line flags.
+// The result is validated, so a nil error means the server can start.
+func Load(args []string) (*Config, error) {
+	// Flags are parsed first to find the config file, but applied last so they win
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "path of a TOML or YAML config file")
+	flagValues := make(map[string]*string)
+	for _, s := range settings {
+		flagValues[s.key] = flags.String(s.flagName(), "", s.usage+" (env "+s.env+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if *configFile != "" {
+		fileValues, err := readFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.apply(fileValues); err != nil {
+			return nil, fmt.Errorf("in %s: %w", *configFile, err)
+		}
+	}
+
+	envValues := make(map[string]string)
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok && value != "" {
+			envValues[s.key] = value
+		}
+	}
+	if err := c.apply(envValues); err != nil {
+		return nil, fmt.Errorf("in environment: %w", err)
+	}
+
+	setFlags := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flagName() == f.Name {
+				setFlags[s.key] = *flagValues[s.key]
+			}
+		}
+	})
+	if err := c.apply(setFlags); err != nil {
+		return nil, fmt.Errorf("in flags: %w", err)
+	}
+
+	// Groq is the default LLM, so its key doubles as the LLM key
+	if c.LLM.Provider == "groq" && c.LLM.APIKey == "" {
+		c.LLM.APIKey = c.Groq.APIKey
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// apply sets every known key in values, complaining about unknown ones
+func (c *Config) apply(values map[string]string) error {
+	var errs []error
+	for key, value := range values {
+		known := false
+		for _, s := range settings {
+			if s.key == key {
+				known = true
+				if err := s.set(c, value); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		if !known {
+			errs = append(errs, fmt.Errorf("unknown setting %q", key))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks that the settings make sense together and reports every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Server.Addr == "" {
+		errs = append(errs, errors.New("server.addr must not be empty"))
+	}
+	if c.DB.Path == "" {
+		errs = append(errs, errors.New("db.path must not be empty"))
+	}
+	if c.History.Window < 1 {
+		errs = append(errs, fmt.Errorf("history.window must be at least 1, got %d", c.History.Window))
+	}
+
+	switch c.LLM.Provider {
+	case "groq":
+		if c.LLM.APIKey == "" {
+			errs = append(errs, errors.New("GROQ_API_KEY (groq.api_key) is required when llm.provider is groq"))
+		}
+	case "openai":
+		if c.LLM.BaseURL == "" {
+			errs = append(errs, errors.New("llm.base_url is required when llm.provider is openai"))
+		}
+		if c.LLM.Model == "" {
+			errs = append(errs, errors.New("llm.model is required when llm.provider is openai"))
+		}
+	case "fake":
+	default:
+		errs = append(errs, fmt.Errorf("llm.provider must be groq, openai or fake, got %q", c.LLM.Provider))
+	}
+
+	if (c.STT.Provider == "deepgram" || c.TTS.Provider == "deepgram") && c.Deepgram.APIKey == "" {
+		errs = append(errs, errors.New("DEEPGRAM_API_KEY (deepgram.api_key) is required when stt.provider or tts.provider is deepgram"))
+	}
+
+	switch c.STT.Provider {
+	case "deepgram":
+	case "local":
+		if strings.TrimSpace(c.STT.LocalCommand) == "" {
+			errs = append(errs, errors.New("stt.local_cmd is required when stt.provider is local"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("stt.provider must be deepgram or local, got %q", c.STT.Provider))
+	}
+	if c.STT.Connect != "lazy" && c.STT.Connect != "eager" {
+		errs = append(errs, fmt.Errorf("stt.connect must be lazy or eager, got %q", c.STT.Connect))
+	}
+	if c.STT.Endpointing <= 0 {
+		errs = append(errs, fmt.Errorf("stt.endpointing must be positive, got %s", c.STT.Endpointing))
+	}
+	// Deepgram won't go lower than that
+	if c.STT.UtteranceEnd < time.Second {
+		errs = append(errs, fmt.Errorf("stt.utterance_end must be at least 1s, got %s", c.STT.UtteranceEnd))
+	}
+
+	switch c.TTS.Provider {
+	case "deepgram":
+		if c.TTS.Voice == "" {
+			errs = append(errs, errors.New("tts.voice must not be empty"))
+		}
+	case "local":
+		if strings.TrimSpace(c.TTS.LocalCommand) == "" {
+			errs = append(errs, errors.New("tts.local_cmd is required when tts.provider is local"))
+		}
+	case "fake":
+	default:
+		errs = append(errs, fmt.Errorf("tts.provider must be deepgram, local or fake, got %q", c.TTS.Provider))
+	}
+	if c.TTS.RateLimit <= 0 {
+		errs = append(errs, fmt.Errorf("tts.rate_limit must be positive, got %s", c.TTS.RateLimit))
+	}
+	switch c.TTS.Cache {
+	case "off", "sqlite":
+	case "disk":
+		if c.TTS.CacheDir == "" {
+			errs = append(errs, errors.New("tts.cache_dir is required when tts.cache is disk"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("tts.cache must be off, disk or sqlite, got %q", c.TTS.Cache))
+	}
+	if c.TTS.Cache != "off" && c.TTS.CacheMaxMB < 1 {
+		errs = append(errs, fmt.Errorf("tts.cache_max_mb must be at least 1, got %d", c.TTS.CacheMaxMB))
+	}
+	if c.TTS.SSML && c.TTS.Provider != "local" {
+		errs = append(errs, fmt.Errorf("tts.ssml only works with tts.provider local, %s doesn't read SSML", c.TTS.Provider))
+	}
+	if c.TTS.ChunkMin < 0 {
+		errs = append(errs, fmt.Errorf("tts.chunk_min_length must not be negative, got %d", c.TTS.ChunkMin))
+	}
+	if c.TTS.ChunkMax < 0 || (c.TTS.ChunkMax > 0 && c.TTS.ChunkMax <= c.TTS.ChunkMin) {
+		errs = append(errs, fmt.Errorf("tts.chunk_max_length must be 0 or more than tts.chunk_min_length, got %d", c.TTS.ChunkMax))
+	}
+	if c.Record.Enabled && c.Record.Dir == "" {
+		errs = append(errs, errors.New("record.dir is required when record.enabled is true"))
+	}
+	if c.Debate.Opening <= 0 {
+		errs = append(errs, fmt.Errorf("debate.opening must be positive, got %s", c.Debate.Opening))
+	}
+	if c.Debate.Rebuttal <= 0 {
+		errs = append(errs, fmt.Errorf("debate.rebuttal must be positive, got %s", c.Debate.Rebuttal))
+	}
+	if c.Debate.CrossExamination <= 0 {
+		errs = append(errs, fmt.Errorf("debate.cross_examination must be positive, got %s", c.Debate.CrossExamination))
+	}
+	if c.Debate.Closing <= 0 {
+		errs = append(errs, fmt.Errorf("debate.closing must be positive, got %s", c.Debate.Closing))
+	}
+
+	return errors.Join(errs...)
+}
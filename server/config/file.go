@@ -0,0 +1,109 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readFile reads a config file into flat "section.key" → value pairs.
+// Only the small subset of TOML and YAML the config needs is understood:
+// one level of sections holding plain scalar values.
+//
+//	# TOML (.toml)          # YAML (.yaml, .yml)
+//	[llm]                   llm:
+//	model = "llama3.1"        model: llama3.1
+func readFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open config file: %w", err)
+	}
+	defer file.Close()
+
+	var yaml bool
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+	case ".yaml", ".yml":
+		yaml = true
+	default:
+		return nil, fmt.Errorf("config file %s must end in .toml, .yaml or .yml", path)
+	}
+
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		raw := scanner.Text()
+		line := strings.TrimSpace(stripComment(raw))
+		if line == "" {
+			continue
+		}
+
+		var key, value string
+		if yaml {
+			k, v, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: expected key: value", path, lineNumber)
+			}
+			key, value = strings.TrimSpace(k), strings.TrimSpace(v)
+			indented := raw != strings.TrimLeft(raw, " \t")
+			if !indented {
+				if value == "" {
+					// A top-level key with nothing after it opens a section
+					section = key
+					continue
+				}
+				section = ""
+			}
+		} else {
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				section = strings.TrimSpace(line[1 : len(line)-1])
+				continue
+			}
+			k, v, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNumber)
+			}
+			key, value = strings.TrimSpace(k), strings.TrimSpace(v)
+		}
+
+		if section != "" {
+			key = section + "." + key
+		}
+		values[key] = unquote(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// stripComment drops a trailing # comment, leaving # inside quotes alone
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 {
+		first, last := value[0], value[len(value)-1]
+		if (first == '"' || first == '\'') && first == last {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
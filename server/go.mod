@@ -2,7 +2,10 @@ module go-websocket-server
 
 go 1.22.5
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/mattn/go-sqlite3 v1.14.22
+)
 
 require (
 	github.com/deepgram/deepgram-go-sdk v1.5.0 // indirect
@@ -14,7 +17,6 @@ require (
 	github.com/hokaccha/go-prettyjson v0.0.0-20211117102719-0474bc63780f // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
-	github.com/mattn/go-sqlite3 v1.14.22 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 	k8s.io/klog/v2 v2.110.1 // indirect
 )
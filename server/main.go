@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
-	"go-websocket-server/api"   // Import the api package
-	"go-websocket-server/utils" // Import utils for DB initialization
+	"go-websocket-server/api"      // Import the api package
+	"go-websocket-server/config"   // Import config to load settings once at startup
+	"go-websocket-server/protocol" // Import protocol to publish its schema
+	"go-websocket-server/session"  // Import session to run each client connection
+	"go-websocket-server/utils"    // Import utils for DB initialization
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 )
 
 // Upgrader for handling WebSocket connections.
@@ -19,133 +28,122 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// Message structure to define the shape of messages passed between the server and the frontend.
-type Message struct {
-	Text           string `json:"text"`
-	ConversationID string `json:"conversationId"`
-	Type           string `json:"type"`
-}
+// Settings and LLM, STT and TTS backends shared by every connection, set up at startup.
+var cfg *config.Config
+var providers session.Providers
 
 func main() {
-	// Initialize the SQLite database.
-	utils.InitDB("./conversation.db")
+	// Values in .env end up as environment variables, which config picks up
+	if err := utils.LoadEnv(".env"); err != nil {
+		log.Println("Could not load .env file:", err)
+	}
+	var err error
+	cfg, err = config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	// Initialize the SQLite database, the TTS cache may live in it
+	utils.InitDB(cfg.DB.Path)
+	providers.LLM, err = api.NewLLMProvider(cfg.LLM)
+	if err != nil {
+		log.Fatalf("Failed to set up LLM provider: %v", err)
+	}
+	providers.STT, err = api.NewSTTProvider(cfg.STT, cfg.Deepgram)
+	if err != nil {
+		log.Fatalf("Failed to set up STT provider: %v", err)
+	}
+	lexicon, err := utils.NewLexicon()
+	if err != nil {
+		log.Fatalf("Failed to load the pronunciation lexicon: %v", err)
+	}
+	providers.TTS, err = api.NewTTSProvider(cfg.TTS, cfg.Deepgram, lexicon)
+	if err != nil {
+		log.Fatalf("Failed to set up TTS provider: %v", err)
+	}
 	// Handle WebSocket connections at the /ws endpoint.
 	http.HandleFunc("/ws", handleWebSocket)
+	// Publish the JSON Schema of the websocket protocol for client authors
+	http.HandleFunc("/protocol/schema.json", protocol.SchemaHandler)
+	// Let clients replay the bot's past replies, see tts.save_audio
+	http.HandleFunc("GET /conversations/{conversationId}/messages/{index}/audio", handleMessageAudio)
+	// Word timings and confidences of spoken messages, e.g. to track down misrecognitions
+	http.HandleFunc("GET /conversations/{conversationId}/messages/{index}/words", handleMessageWords)
+	// Hit and miss counts of the TTS cache, see tts.cache. The cache sits under the lexicon, if there's one.
+	tts := providers.TTS
+	if lexiconTTS, ok := tts.(*api.LexiconTTS); ok {
+		tts = lexiconTTS.TTSProvider
+	}
+	if cached, ok := tts.(*api.CachedTTS); ok {
+		http.HandleFunc("GET /tts/cache/stats", cached.StatsHandler)
+	}
+	// Let operators edit the pronunciation lexicon and the personas without a restart
+	if cfg.Admin.Token != "" {
+		admin := lexiconAdmin{lexicon}
+		http.HandleFunc("GET /admin/lexicon", requireAdmin(admin.list))
+		http.HandleFunc("POST /admin/lexicon", requireAdmin(admin.set))
+		http.HandleFunc("DELETE /admin/lexicon/{word}", requireAdmin(admin.remove))
+		http.HandleFunc("POST /admin/lexicon/reload", requireAdmin(admin.reload))
+		http.HandleFunc("GET /admin/personas", requireAdmin(listPersonas))
+		http.HandleFunc("POST /admin/personas", requireAdmin(savePersona))
+		http.HandleFunc("DELETE /admin/personas/{id}", requireAdmin(deletePersona))
+	} else {
+		log.Println("admin.token is not set, the admin endpoints are off")
+	}
 
-	fmt.Println("Server is running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
-
-// These three goroutines handle sending data back to the user:
-// SendTranscriptToClient - Streams STT data from the deepgram websocket as a user message
-// SendTextToClient - Streams text from Groq as a bot message
-// SendAudioToClient - Sends audio from deepgram as a single file
-func makeTurnChannels(userTranscript chan string,
-	writeChan chan utils.WebSocketPacket,
-	stopChan chan bool) (userMessage chan string,
-	botTextForClient chan string,
-	botTextForTTS chan string,
-) {
-	userMessage = make(chan string) // Channel for entire user transcript as a single string
-	go api.SendTranscriptToClient(userTranscript, userMessage, writeChan, stopChan)
-
-	botAudio := make(chan []byte)
-	go api.SendAudioToClient(botAudio, writeChan)
-
-	botTextForClient = make(chan string)
-	botTextForTTS = make(chan string)
-	go api.BufferTextForTTS(botTextForTTS, botAudio)
-	go api.SendTextToClient(botTextForClient, writeChan)
-	return userMessage, botTextForClient, botTextForTTS
+	fmt.Println("Server is running on", cfg.Server.Addr)
+	log.Fatal(http.ListenAndServe(cfg.Server.Addr, nil))
 }
 
-// handleWebSocket handles incoming WebSocket data packets.
+// handleWebSocket upgrades the request and runs a session on it until the client goes away.
+// See the session package for how each conversational turn is handled.
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil) // Upgrade to a WebSocket connection.
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	// Single channel for outbound data on the websocket
-	writeChan := make(chan utils.WebSocketPacket)
-	go utils.WriteToWebsocket(writeChan, conn)
-	// Initialize Deepgram WebSocket connection
-	// and channel to hold the user transcript stream
-	userTranscript := make(chan string) // channel for streaming audio transcript
-	stopChan := make(chan bool)
-	// Part of initializing the deepgram connection is listening for packets
-	// and sending them to the userTranscript channel
-	deepgramConn, err := api.NewDeepgramConnection(userTranscript, stopChan)
+	session.New(conn, providers, cfg).Run()
+}
+
+// handleMessageAudio serves the saved audio of a message.
+// ServeContent handles range requests, so players can seek in it.
+func handleMessageAudio(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
 	if err != nil {
-		log.Fatalf("Failed to connect to Deepgram: %v", err)
+		http.Error(w, "message index must be a number", http.StatusBadRequest)
+		return
 	}
-	defer conn.Close() // Ensure the connection is closed when done.
-	userMessage, botTextForClient, botTextForTTS := makeTurnChannels(userTranscript, writeChan, stopChan)
-
-	for {
-		messageType, p, err := conn.ReadMessage()
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		if messageType == websocket.TextMessage {
-			var message Message
-			if err := json.Unmarshal(p, &message); err != nil {
-				log.Println("Error unmarshaling message:", err)
-				continue
-			}
-			if message.Type == "audioEnd" {
-				log.Println("Received audioEnd message, waiting for final transcripts")
-				// Send a special Finalize message to Deepgram
-				log.Println("Finalizing deepgram transcription")
-				m := "{\"type\":\"Finalize\"}"
-				deepgramConn.WriteMessage(websocket.TextMessage, []byte(m))
-				log.Println("Sending stop signal..")
-				stopChan <- true // tell the listener to stop
-				close(stopChan)
-				// Wait for all transcripts to be processed and returned
-				// This is taking waaaay too long!!
-				log.Println("Compiling full transcript...")
-				fullTranscript := <-userMessage
-				message.Text = fullTranscript
-				log.Printf("Full transcript is %s", fullTranscript)
-			}
-			log.Printf("Sending text to llama: %s", message.Text)
-
-			if message.ConversationID == "" {
-				log.Println("Error: ConversationID is empty")
-				continue
-			}
-			go api.AskLlama(message.ConversationID, message.Text, botTextForClient, botTextForTTS)
-			// Re-open these two channels
-			log.Println("Re-opening channels")
-			userTranscript = make(chan string)
-			stopChan = make(chan bool)
-			userMessage, botTextForClient, botTextForTTS = makeTurnChannels(userTranscript, writeChan, stopChan)
-			deepgramConn, err = api.NewDeepgramConnection(userTranscript, stopChan)
-
-		} else if messageType == websocket.BinaryMessage {
-			log.Printf("Received %d bytes of audio data", len(p))
+	mimeType, audio, err := utils.GetMessageAudio(r.PathValue("conversationId"), index)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read message audio: %v", err)
+		http.Error(w, "failed to read the audio", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mimeType)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(audio))
+}
 
-			// Send the audio chunk to Deepgram directly
-			err := deepgramConn.WriteMessage(websocket.BinaryMessage, p)
-			if err != nil {
-				// Reconnect and try again
-				deepgramConn, err = api.NewDeepgramConnection(userTranscript, stopChan)
-				if err != nil {
-					log.Fatalf("Failed to connect to Deepgram: %v", err)
-				} else {
-					err := deepgramConn.WriteMessage(websocket.BinaryMessage, p)
-					if err != nil {
-						log.Fatal("Failed to re-connect to Deepgram:", err)
-					} else {
-						log.Println("Successfully sent chunk to deepgram on the second try")
-					}
-				}
-			} else {
-				log.Println("Successfully sent chunk to Deepgram")
-			}
-		}
+// handleMessageWords serves the word timings and confidences of a message as JSON,
+// an empty list for typed messages and replies
+func handleMessageWords(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		http.Error(w, "message index must be a number", http.StatusBadRequest)
+		return
+	}
+	words, err := utils.GetMessageWords(r.PathValue("conversationId"), index)
+	if err != nil {
+		log.Printf("Failed to read message words: %v", err)
+		http.Error(w, "failed to read the words", http.StatusInternalServerError)
+		return
+	}
+	if words == nil {
+		words = []utils.Word{}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(words)
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"go-websocket-server/utils"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHandleMessageWords(t *testing.T) {
+	utils.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	defer utils.DB.Close()
+	words := []utils.Word{
+		{Word: "hello", Start: 0.1, End: 0.4, Confidence: 0.98},
+		{Word: "there", Start: 0.5, End: 0.8, Confidence: 0.42},
+	}
+	if err := utils.SaveMessageWords("c1", 0, words); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /conversations/{conversationId}/messages/{index}/words", handleMessageWords)
+	tests := []struct {
+		path   string
+		status int
+		want   []utils.Word
+	}{
+		{"/conversations/c1/messages/0/words", http.StatusOK, words},
+		{"/conversations/c1/messages/1/words", http.StatusOK, []utils.Word{}},
+		{"/conversations/c2/messages/0/words", http.StatusOK, []utils.Word{}},
+		{"/conversations/c1/messages/first/words", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.path, rec.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var got []utils.Word
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.path, got, test.want)
+		}
+	}
+}
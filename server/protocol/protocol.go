@@ -0,0 +1,220 @@
+// Package protocol defines the messages exchanged with clients over the websocket.
+// Everything the server sends is a JSON Envelope; schema.json describes all of it
+// and is served at /protocol/schema.json for client authors.
+package protocol
+
+import (
+	_ "embed"
+	"encoding/json"
+	"go-websocket-server/utils"
+	"net/http"
+)
+
+// Version is bumped whenever a change would break existing clients
+const Version = 1
+
+// Server → client event types
+const (
+	TranscriptInterim = "transcript.interim" // hypothesis for the segment being spoken, replaces the previous interim
+	TranscriptFinal   = "transcript.final"   // finalized piece of the user's transcript
+	BotTextDelta      = "bot.text.delta"     // next piece of the bot's reply text
+	BotAudioChunk     = "bot.audio.chunk"    // next piece of the bot's reply audio
+	BotAudioEnd       = "bot.audio.end"      // a sentence's audio is complete
+	TurnDone          = "turn.done"          // nothing more will be sent for this turn
+	PhaseStart        = "phase.start"        // a phase of the debate began, see PhaseStartPayload
+	PhaseEnd          = "phase.end"          // a phase of the debate ran out of time
+	Error             = "error"              // something went wrong, see ErrorPayload
+)
+
+// Client → server message types
+const (
+	SessionStart   = "session.start" // sets up the session, e.g. switches to hands-free mode, picks a persona or starts a debate
+	UserText       = "user.text"     // a typed message
+	AudioEnd       = "audio.end"     // the user stopped recording, finish the transcript and reply to it
+	Interrupt      = "interrupt"     // stop the bot's current reply
+	legacyAudioEnd = "audioEnd"
+)
+
+// Session modes, set with session.start
+const (
+	PushToTalk = "push_to_talk" // the client sends audio.end when the user is done talking (default)
+	HandsFree  = "hands_free"   // the microphone stays open and the server detects when the user is done
+)
+
+// When a push-to-talk turn opens its STT stream, set with session.start
+const (
+	LazySTT  = "lazy"  // on the turn's first audio, so text-only turns never hold an upstream connection
+	EagerSTT = "eager" // as soon as the turn starts, so the first words aren't held up by the handshake
+)
+
+// Sides of a debate, set with session.start
+const (
+	DebateFor     = "for"
+	DebateAgainst = "against"
+)
+
+// Phases of a debate, in the order they run
+const (
+	PhaseOpening          = "opening"
+	PhaseRebuttal         = "rebuttal"
+	PhaseCrossExamination = "cross_examination"
+	PhaseClosing          = "closing"
+)
+
+// Envelope wraps every event sent to the client.
+// TurnID ties the event to a turn, Seq orders events within that turn, starting at 0.
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	TurnID  int             `json:"turnId"`
+	Seq     int             `json:"seq"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// TextPayload carries the text of transcript.interim and bot.text.delta events
+type TextPayload struct {
+	Text string `json:"text"`
+}
+
+// TranscriptPayload carries a finalized piece of the user's transcript.
+// Words has the timing and confidence of each word, when the STT engine gives them.
+type TranscriptPayload struct {
+	Text  string       `json:"text"`
+	Words []utils.Word `json:"words,omitempty"`
+}
+
+// AudioChunkPayload carries a piece of bot audio, base64 encoded in JSON.
+// Sentence is the sentence's position in the reply and Chunk the piece's position in the sentence,
+// both from 0. Together, a sentence's chunks make one playable file.
+type AudioChunkPayload struct {
+	MimeType string `json:"mimeType"`
+	Data     []byte `json:"data"`
+	Sentence int    `json:"sentence"`
+	Chunk    int    `json:"chunk"`
+}
+
+// AudioEndPayload follows the last chunk of a sentence. Chunks is how many there were,
+// zero if the sentence couldn't be synthesized.
+type AudioEndPayload struct {
+	Sentence int `json:"sentence"`
+	Chunks   int `json:"chunks"`
+}
+
+// TurnDonePayload closes a turn. Interrupted is set when the reply was cut off.
+// AudioURL is where the reply's audio can be fetched again, when the server keeps it.
+type TurnDonePayload struct {
+	Interrupted bool   `json:"interrupted"`
+	AudioURL    string `json:"audioUrl,omitempty"`
+}
+
+// PhaseStartPayload announces a phase of the debate. UserSide is the side the user argues,
+// the bot argues the other one. RemainingMs is how long the phase has left.
+type PhaseStartPayload struct {
+	Phase       string `json:"phase"`
+	Resolution  string `json:"resolution"`
+	UserSide    string `json:"userSide"`
+	RemainingMs int64  `json:"remainingMs"`
+}
+
+// PhaseEndPayload closes a phase of the debate. Next is the phase that starts now,
+// empty when the debate is over.
+type PhaseEndPayload struct {
+	Phase string `json:"phase"`
+	Next  string `json:"next,omitempty"`
+}
+
+// ErrorPayload describes a failure. Code is machine readable (auth, rate_limit,
+// upstream_unavailable or bad_input), Message can be shown to the user.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ClientMessage is anything the client sends as a text frame.
+// Audio is sent separately as raw binary frames.
+type ClientMessage struct {
+	Version        int            `json:"v"`
+	Type           string         `json:"type"`
+	ConversationID string         `json:"conversationId"`
+	Text           string         `json:"text"`
+	Mode           string         `json:"mode"`             // for session.start
+	Listen         *ListenOptions `json:"listen,omitempty"` // for session.start
+	STTConnect     string         `json:"sttConnect"`       // for session.start
+	Persona        string         `json:"persona"`          // for session.start, binds the conversation to a persona
+	Debate         *DebateOptions `json:"debate,omitempty"` // for session.start, starts a debate in the conversation
+}
+
+// DebateOptions start a debate: the user argues Side (for or against) of Resolution
+// and the bot argues the other side.
+type DebateOptions struct {
+	Resolution string `json:"resolution"`
+	Side       string `json:"side"`
+}
+
+// ListenOptions tune speech recognition for a session. They're sent with session.start
+// and apply to every STT stream opened after it. Unset fields keep the server's defaults.
+type ListenOptions struct {
+	Model       string   `json:"model,omitempty"`    // e.g. nova-2
+	Language    string   `json:"language,omitempty"` // BCP-47 tag, e.g. en-US or fr
+	SmartFormat *bool    `json:"smartFormat,omitempty"`
+	Punctuate   *bool    `json:"punctuate,omitempty"`
+	Diarize     *bool    `json:"diarize,omitempty"`
+	Keywords    []string `json:"keywords,omitempty"`   // words to boost, optionally with an intensifier like "Groq:2"
+	Encoding    string   `json:"encoding,omitempty"`   // only for raw audio, e.g. linear16; leave empty for containers like webm
+	SampleRate  int      `json:"sampleRate,omitempty"` // in Hz, required with encoding
+}
+
+// Merge returns o with every field that is set in override replaced
+func (o ListenOptions) Merge(override ListenOptions) ListenOptions {
+	if override.Model != "" {
+		o.Model = override.Model
+	}
+	if override.Language != "" {
+		o.Language = override.Language
+	}
+	if override.SmartFormat != nil {
+		o.SmartFormat = override.SmartFormat
+	}
+	if override.Punctuate != nil {
+		o.Punctuate = override.Punctuate
+	}
+	if override.Diarize != nil {
+		o.Diarize = override.Diarize
+	}
+	if override.Keywords != nil {
+		o.Keywords = override.Keywords
+	}
+	if override.Encoding != "" {
+		o.Encoding = override.Encoding
+	}
+	if override.SampleRate != 0 {
+		o.SampleRate = override.SampleRate
+	}
+	return o
+}
+
+// IsZero reports whether no option is set
+func (o ListenOptions) IsZero() bool {
+	return o.Model == "" && o.Language == "" && o.SmartFormat == nil && o.Punctuate == nil &&
+		o.Diarize == nil && len(o.Keywords) == 0 && o.Encoding == "" && o.SampleRate == 0
+}
+
+// Normalize maps messages from clients that predate the versioned protocol
+// onto the current types: {"type":"audioEnd"} and untyped text messages.
+func (m *ClientMessage) Normalize() {
+	switch m.Type {
+	case legacyAudioEnd:
+		m.Type = AudioEnd
+	case "":
+		m.Type = UserText
+	}
+}
+
+//go:embed schema.json
+var schema []byte
+
+// SchemaHandler serves the JSON Schema of the protocol
+func SchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(schema)
+}
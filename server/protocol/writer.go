@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"go-websocket-server/utils"
+	"log"
+	"sync"
+)
+
+// TurnWriter sends events for a single turn, stamping each one
+// with the turn's ID and the next sequence number.
+// It is safe to use from several goroutines.
+type TurnWriter struct {
+	turnID    int
+	writeChan chan<- utils.WebSocketPacket
+
+	mu  sync.Mutex
+	seq int
+}
+
+func NewTurnWriter(turnID int, writeChan chan<- utils.WebSocketPacket) *TurnWriter {
+	return &TurnWriter{turnID: turnID, writeChan: writeChan}
+}
+
+// Send wraps payload in an envelope and queues it for the websocket.
+// Gives up without sending if ctx is cancelled first.
+func (w *TurnWriter) Send(ctx context.Context, eventType string, payload any) error {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	// Hold the lock until the packet is queued so sequence numbers go out in order
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data, err := json.Marshal(Envelope{
+		Version: Version,
+		Type:    eventType,
+		TurnID:  w.turnID,
+		Seq:     w.seq,
+		Payload: payloadJSON,
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case w.writeChan <- utils.WebSocketPacket{Type: utils.TextMessage, Data: data}:
+		w.seq++
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SendText is a shortcut for events whose payload is just text
+func (w *TurnWriter) SendText(ctx context.Context, eventType string, text string) {
+	if err := w.Send(ctx, eventType, TextPayload{Text: text}); err != nil && ctx.Err() == nil {
+		log.Printf("Error sending %s event: %v", eventType, err)
+	}
+}
@@ -0,0 +1,12 @@
+#!/bin/sh
+# Offline STT engine for STT_PROVIDER=local, built on whisper.cpp.
+# Reads the browser's audio (webm/opus) on stdin and prints the transcript on stdout.
+# Usage in .env:
+#   STT_PROVIDER=local
+#   STT_LOCAL_CMD=./scripts/whisper-stt.sh
+# Needs ffmpeg and whisper-cli on the PATH, and WHISPER_MODEL pointing at a ggml model.
+set -e
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+ffmpeg -loglevel error -i - -ar 16000 -ac 1 -c:a pcm_s16le "$tmp/audio.wav"
+whisper-cli -m "${WHISPER_MODEL:-models/ggml-base.en.bin}" -f "$tmp/audio.wav" -nt -np
@@ -0,0 +1,239 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"go-websocket-server/config"
+	"go-websocket-server/protocol"
+	"go-websocket-server/utils"
+	"log"
+	"strings"
+	"time"
+)
+
+// debatePhases are the phases of a debate in the order they run
+var debatePhases = []string{
+	protocol.PhaseOpening,
+	protocol.PhaseRebuttal,
+	protocol.PhaseCrossExamination,
+	protocol.PhaseClosing,
+}
+
+// debateOver is the phase of a debate whose last phase ran out of time
+const debateOver = "over"
+
+// What the bot is told in every phase. The resolution, then the user's side and the bot's.
+const debatePreamble = `You are in a formal debate with the user on the resolution: "%s". ` +
+	`The user argues %s it and you argue %s it. Hold your side whatever the user says, ` +
+	`argue with facts and reasoning rather than attacks, and stay civil. ` +
+	`Your replies are read aloud, so answer in plain spoken sentences without markdown or lists.`
+
+// What the bot is told to do in each phase, on top of the preamble
+var phasePrompts = map[string]string{
+	protocol.PhaseOpening: "This is the opening statements. Make your case with your two or three strongest arguments. " +
+		"Don't rebut the user yet. Keep it under 150 words.",
+	protocol.PhaseRebuttal: "This is the rebuttal. Take on the user's arguments one at a time and show where they fall short, " +
+		"then say why your case still stands. Keep it under 150 words.",
+	protocol.PhaseCrossExamination: "This is the cross-examination. Answer the user's questions briefly and directly, " +
+		"then ask them one pointed question about a weakness in their case. Keep it under 60 words.",
+	protocol.PhaseClosing: "This is the closing statements. Sum up why your side wins without bringing up new arguments. " +
+		"Keep it under 120 words.",
+	debateOver: "The debate is over. If the user asks, give a fair, short summary of the strongest points of both sides, " +
+		"but don't declare a winner.",
+}
+
+// phaseLength is how long a phase of a debate lasts
+func phaseLength(cfg *config.Config, phase string) time.Duration {
+	switch phase {
+	case protocol.PhaseOpening:
+		return cfg.Debate.Opening
+	case protocol.PhaseRebuttal:
+		return cfg.Debate.Rebuttal
+	case protocol.PhaseCrossExamination:
+		return cfg.Debate.CrossExamination
+	case protocol.PhaseClosing:
+		return cfg.Debate.Closing
+	}
+	return 0
+}
+
+// nextPhase returns the phase that comes after phase, debateOver after the last one
+func nextPhase(phase string) string {
+	for i, p := range debatePhases[:len(debatePhases)-1] {
+		if p == phase {
+			return debatePhases[i+1]
+		}
+	}
+	return debateOver
+}
+
+// catchUp returns the debate as it stands at now, past every phase that has run out of time.
+// Each phase starts when the one before it ends, even if nobody was connected to see it.
+func catchUp(cfg *config.Config, d utils.Debate, now time.Time) utils.Debate {
+	for d.Phase != debateOver && !now.Before(d.PhaseEndsAt) {
+		d.Phase = nextPhase(d.Phase)
+		d.PhaseEndsAt = d.PhaseEndsAt.Add(phaseLength(cfg, d.Phase))
+	}
+	return d
+}
+
+// debatePrompt is the system prompt for the conversation's debate in its current phase,
+// empty if the conversation isn't a debate
+func debatePrompt(cfg *config.Config, conversationID string) (string, error) {
+	d, err := utils.GetDebate(conversationID)
+	if err != nil || d == nil {
+		return "", err
+	}
+	botSide := protocol.DebateAgainst
+	if d.UserSide == protocol.DebateAgainst {
+		botSide = protocol.DebateFor
+	}
+	phase := catchUp(cfg, *d, time.Now()).Phase
+	return fmt.Sprintf(debatePreamble, d.Resolution, d.UserSide, botSide) + "\n\n" + phasePrompts[phase], nil
+}
+
+// debateClock tells the client when the phases of the conversation's debate end.
+// A session has one while the conversation it was started for has a debate going.
+type debateClock struct {
+	conversationID string
+	phase          string // the phase the client was last told about
+	timer          *time.Timer
+}
+
+// startDebate starts a debate in the conversation from its first phase, replacing any it had.
+// The caller must hold s.mu.
+func (s *Session) startDebate(conversationID string, opts protocol.DebateOptions) error {
+	resolution := strings.TrimSpace(opts.Resolution)
+	if resolution == "" {
+		return badInput(errors.New("a debate needs a resolution"))
+	}
+	if opts.Side != protocol.DebateFor && opts.Side != protocol.DebateAgainst {
+		return badInput(fmt.Errorf("debate side must be for or against, got %q", opts.Side))
+	}
+	d := utils.Debate{
+		ConversationID: conversationID,
+		Resolution:     resolution,
+		UserSide:       opts.Side,
+		Phase:          debatePhases[0],
+		PhaseEndsAt:    time.Now().Add(phaseLength(s.cfg, debatePhases[0])),
+	}
+	if err := utils.SaveDebate(d); err != nil {
+		return err
+	}
+	log.Printf("Conversation %s is now a debate, the user argues %s %q", conversationID, opts.Side, resolution)
+	s.stopDebateClock()
+	s.followDebate(d)
+	return nil
+}
+
+// watchDebate follows the conversation's debate, if it has one going,
+// e.g. when the client comes back to it after a reload.
+// The clock kept running while nobody was connected, so it may be in a later phase by now.
+// The caller must hold s.mu.
+func (s *Session) watchDebate(conversationID string) error {
+	if s.debate != nil && s.debate.conversationID == conversationID {
+		return nil
+	}
+	s.stopDebateClock()
+	d, err := utils.GetDebate(conversationID)
+	if err != nil || d == nil {
+		return err
+	}
+	current, err := s.syncDebate(*d)
+	if err != nil {
+		return err
+	}
+	s.followDebate(current)
+	return nil
+}
+
+// followDebate tells the client about the phase the debate is in
+// and starts the clock that ends it. Nothing happens once the debate is over.
+// The caller must hold s.mu.
+func (s *Session) followDebate(d utils.Debate) {
+	if d.Phase == debateOver {
+		s.debate = nil
+		return
+	}
+	s.sendEvent(protocol.PhaseStart, protocol.PhaseStartPayload{
+		Phase:       d.Phase,
+		Resolution:  d.Resolution,
+		UserSide:    d.UserSide,
+		RemainingMs: time.Until(d.PhaseEndsAt).Milliseconds(),
+	})
+	clock := &debateClock{conversationID: d.ConversationID, phase: d.Phase}
+	clock.timer = time.AfterFunc(time.Until(d.PhaseEndsAt), func() { s.endPhase(clock) })
+	s.debate = clock
+}
+
+// endPhase runs when the phase the client knows about should be over
+func (s *Session) endPhase(clock *debateClock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.debate != clock || s.ctx.Err() != nil {
+		return
+	}
+	d, err := utils.GetDebate(clock.conversationID)
+	if err == nil && d != nil {
+		var current utils.Debate
+		current, err = s.syncDebate(*d)
+		d = &current
+	}
+	if err != nil {
+		log.Printf("Failed to move the debate of conversation %s on, trying again: %v", clock.conversationID, err)
+		clock.timer.Reset(time.Second)
+		return
+	}
+	if d == nil {
+		s.stopDebateClock()
+		return
+	}
+	if d.Phase == clock.phase {
+		// Started over on another connection, the clock goes by the new debate
+		clock.timer.Reset(time.Until(d.PhaseEndsAt))
+		return
+	}
+	next := d.Phase
+	if next == debateOver {
+		next = ""
+	}
+	s.sendEvent(protocol.PhaseEnd, protocol.PhaseEndPayload{Phase: clock.phase, Next: next})
+	s.followDebate(*d)
+}
+
+// syncDebate stores the phase the debate is in by now and returns it
+func (s *Session) syncDebate(d utils.Debate) (utils.Debate, error) {
+	for {
+		current := catchUp(s.cfg, d, time.Now())
+		if current.Phase == d.Phase {
+			return d, nil
+		}
+		ok, err := utils.AdvanceDebate(d, current)
+		if err != nil || ok {
+			return current, err
+		}
+		// Someone else got there first, go by what they stored
+		stored, err := utils.GetDebate(d.ConversationID)
+		if err != nil || stored == nil {
+			return current, err
+		}
+		d = *stored
+	}
+}
+
+// stopDebateClock stops telling the client about the phases of the debate it followed.
+// The caller must hold s.mu.
+func (s *Session) stopDebateClock() {
+	if s.debate != nil {
+		s.debate.timer.Stop()
+		s.debate = nil
+	}
+}
+
+// sendEvent sends an event that isn't part of any reply, on the listening turn.
+// The caller must hold s.mu.
+func (s *Session) sendEvent(eventType string, payload any) {
+	if err := s.listening.events.Send(s.ctx, eventType, payload); err != nil && s.ctx.Err() == nil {
+		log.Printf("Error sending %s event: %v", eventType, err)
+	}
+}
@@ -0,0 +1,26 @@
+package session
+
+import (
+	"context"
+	"go-websocket-server/api"
+	"go-websocket-server/protocol"
+	"log"
+)
+
+// sendError tells the client about a failure with an error event.
+// The code is one of api's error kinds, the message is safe to show to users.
+func sendError(ctx context.Context, events *protocol.TurnWriter, err error) {
+	providerErr := api.AsProviderError(err)
+	payload := protocol.ErrorPayload{
+		Code:    string(providerErr.Kind),
+		Message: providerErr.UserMessage(),
+	}
+	if sendErr := events.Send(ctx, protocol.Error, payload); sendErr != nil && ctx.Err() == nil {
+		log.Printf("Error sending error event: %v", sendErr)
+	}
+}
+
+// badInput is for client messages the session can't act on
+func badInput(err error) error {
+	return &api.ProviderError{Kind: api.ErrBadInput, Provider: "the server", Err: err}
+}
@@ -0,0 +1,130 @@
+package session
+
+import (
+	"go-websocket-server/api"
+	"go-websocket-server/protocol"
+	"go-websocket-server/utils"
+	"log"
+	"strings"
+	"sync"
+)
+
+// handsFreeListener feeds one STT stream that stays open across turns.
+// Final transcripts go to the listening turn, and once the engine hears the user
+// stop talking, what they said becomes that turn's message.
+type handsFreeListener struct {
+	session        *Session
+	stream         api.STTStream
+	conversationID string // guarded by session.mu
+
+	header []byte // the stream's first chunk of audio, guarded by session.mu
+
+	mu        sync.Mutex
+	utterance api.Transcript   // final transcript since the last end of utterance
+	recording *utils.Recording // audio since the last end of utterance
+}
+
+// startHandsFree opens the session's hands-free stream.
+// The caller must hold s.mu.
+func (s *Session) startHandsFree(conversationID string) error {
+	stream, err := s.providers.STT.OpenStream(s.ctx, api.STTOptions{
+		Endpointing:  s.cfg.STT.Endpointing,
+		UtteranceEnd: s.cfg.STT.UtteranceEnd,
+		Listen:       s.listenOptions(),
+	})
+	if err != nil {
+		return err
+	}
+	// The listening turn's own stream won't get any audio anymore
+	s.listening.stopListening()
+	h := &handsFreeListener{session: s, stream: stream, conversationID: conversationID}
+	s.handsFree = h
+	go h.run()
+	log.Println("Hands-free mode on")
+	return nil
+}
+
+// stopHandsFree closes the hands-free stream.
+// Anything said since the last end of utterance is dropped.
+// The caller must hold s.mu.
+func (s *Session) stopHandsFree() {
+	s.handsFree.stream.Close()
+	s.handsFree = nil
+	log.Println("Hands-free mode off")
+}
+
+// run reads the stream until it's closed.
+// Deepgram sends speech_final after a short pause and UtteranceEnd after a longer gap
+// between words, which still works when background noise keeps the pause from being detected.
+// Whichever comes first ends the utterance.
+func (h *handsFreeListener) run() {
+	for event := range h.stream.Events() {
+		if !event.IsFinal && event.Text != "" {
+			turn := h.session.currentListening()
+			turn.events.SendText(turn.ctx, protocol.TranscriptInterim, event.Text)
+		}
+		if event.IsFinal && strings.TrimSpace(event.Text) != "" {
+			h.addFinal(event)
+		}
+		if event.SpeechFinal || event.UtteranceEnd {
+			h.endUtterance()
+		}
+	}
+}
+
+// record keeps a copy of a chunk of the stream's audio for the current utterance.
+// Containers like webm only have a header at the start of the stream,
+// so every utterance's recording starts with the stream's first chunk.
+// The caller must hold session.mu.
+func (h *handsFreeListener) record(audio []byte) {
+	var header []byte
+	if h.header == nil {
+		h.header = audio
+	} else {
+		header = h.header
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.recording == nil {
+		h.recording = h.session.newRecording(header)
+	}
+	h.recording.Write(audio)
+}
+
+// addFinal adds a finalized segment to the utterance and shows it to the client.
+// The user talking over the bot cuts its reply off, like a barge-in in push-to-talk mode.
+func (h *handsFreeListener) addFinal(event api.TranscriptEvent) {
+	h.session.interrupt()
+
+	h.mu.Lock()
+	h.utterance.Add(event)
+	h.mu.Unlock()
+
+	log.Println("Transcript:", event.Text)
+	turn := h.session.currentListening()
+	api.SendFinalTranscript(turn.ctx, event, turn.events)
+}
+
+// endUtterance hands whatever the user said to the listening turn for a reply
+func (h *handsFreeListener) endUtterance() {
+	h.mu.Lock()
+	utterance := h.utterance
+	utterance.Audio = h.recording
+	h.utterance = api.Transcript{}
+	h.recording = nil
+	h.mu.Unlock()
+	utterance.Text = strings.TrimSpace(utterance.Text)
+	if utterance.Text == "" {
+		return
+	}
+
+	h.session.mu.Lock()
+	active := h.session.handsFree == h
+	conversationID := h.conversationID
+	h.session.mu.Unlock()
+	if !active {
+		return
+	}
+	log.Printf("Full transcript is %s", utterance.Text)
+	h.session.respondTo(conversationID, utterance)
+}
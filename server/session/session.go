@@ -0,0 +1,468 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"go-websocket-server/api"
+	"go-websocket-server/config"
+	"go-websocket-server/protocol"
+	"go-websocket-server/utils"
+	"log"
+	"sync"
+)
+
+// Providers are the backends every turn of a session talks to
+type Providers struct {
+	LLM api.LLMProvider
+	STT api.STTProvider
+	TTS api.TTSProvider
+}
+
+// Session owns one client websocket for as long as it stays open.
+// At any time it has one turn listening for the user's next message,
+// and at most one turn whose reply is in flight.
+type Session struct {
+	conn      *websocket.Conn
+	providers Providers
+	cfg       *config.Config
+	writeChan chan utils.WebSocketPacket // single channel for outbound data on the websocket
+	recorder  *utils.Recorder            // nil unless the user's audio is recorded
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	nextTurnID int
+	listening  *Turn
+	responding *Turn
+	handsFree  *handsFreeListener     // nil in push-to-talk mode
+	listen     protocol.ListenOptions // the client's STT settings from session.start
+	sttConnect string                 // when push-to-talk turns open their STT stream, lazy or eager
+	language   string                 // the STT language of the persona of the conversation from session.start
+	debate     *debateClock           // nil unless the conversation from session.start has a debate going
+}
+
+func New(conn *websocket.Conn, providers Providers, cfg *config.Config) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	var recorder *utils.Recorder
+	if cfg.Record.Enabled {
+		recorder = &utils.Recorder{Dir: cfg.Record.Dir}
+	}
+	return &Session{
+		conn:       conn,
+		providers:  providers,
+		cfg:        cfg,
+		writeChan:  make(chan utils.WebSocketPacket),
+		recorder:   recorder,
+		ctx:        ctx,
+		cancel:     cancel,
+		sttConnect: cfg.STT.Connect,
+	}
+}
+
+// Run reads from the client until the socket closes,
+// or until the session fails in a way it can't recover from.
+// When it returns, every turn of the session has been cancelled.
+func (s *Session) Run() {
+	writerDone := make(chan struct{})
+	go func() {
+		utils.WriteToWebsocket(s.ctx, s.writeChan, s.conn)
+		close(writerDone)
+	}()
+	defer s.conn.Close()
+	defer func() {
+		// Let the writer finish what it's sending, e.g. a last error event
+		s.cancel()
+		s.mu.Lock()
+		s.stopDebateClock()
+		s.mu.Unlock()
+		<-writerDone
+	}()
+
+	s.mu.Lock()
+	err := s.startListening()
+	s.mu.Unlock()
+	if err != nil {
+		s.fail(err)
+		return
+	}
+
+	for {
+		messageType, p, err := s.conn.ReadMessage()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if messageType == websocket.TextMessage {
+			var message protocol.ClientMessage
+			if err := json.Unmarshal(p, &message); err != nil {
+				log.Println("Error unmarshaling message:", err)
+				continue
+			}
+			message.Normalize()
+			if err := s.handleMessage(message); err != nil {
+				s.fail(err)
+				return
+			}
+		} else if messageType == websocket.BinaryMessage {
+			log.Printf("Received %d bytes of audio data", len(p))
+			if err := s.sendAudio(p); err != nil {
+				s.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// sendAudio passes a chunk of user audio to the STT engine: the hands-free stream
+// if there is one, the listening turn's otherwise.
+// A returned error means the session can't go on.
+func (s *Session) sendAudio(audio []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handsFree != nil {
+		s.handsFree.record(audio)
+		if err := s.handsFree.stream.SendAudio(audio); err != nil {
+			// The client only sends its audio header once, so a new stream couldn't decode
+			// the rest of it. Fall back to push-to-talk and let the user start over.
+			log.Println("Failed to send audio to STT provider:", err)
+			s.listening.reportError(err)
+			s.stopHandsFree()
+			return s.prepareListening()
+		}
+		return nil
+	}
+
+	if !s.listening.hasSTT() {
+		// Lazy mode: the turn only gets a stream now that there's audio for it
+		if err := s.listening.listen(s.providers.STT, s.sttOptions()); err != nil {
+			return err
+		}
+	}
+	s.listening.record(audio, func() *utils.Recording { return s.newRecording(nil) })
+	// Send the audio chunk to the STT engine directly
+	if err := s.listening.SendAudio(audio); err != nil {
+		// This turn's audio is lost, tell the client and start over with a fresh stream
+		log.Println("Failed to send audio to STT provider:", err)
+		s.listening.reportError(err)
+		return s.restartListening()
+	}
+	log.Println("Successfully sent chunk to STT provider")
+	return nil
+}
+
+// newRecording starts a recording of the user's audio, if the session records it.
+// header goes first, see utils.Recorder.Start.
+// The caller must hold s.mu.
+func (s *Session) newRecording(header []byte) *utils.Recording {
+	encoding, sampleRate := s.listen.Encoding, s.listen.SampleRate
+	if encoding == "" {
+		encoding, sampleRate = s.cfg.STT.Encoding, s.cfg.STT.SampleRate
+	}
+	return s.recorder.Start(encoding, sampleRate, header)
+}
+
+// startListening opens a new turn to collect the user's next message.
+// The caller must hold s.mu.
+func (s *Session) startListening() error {
+	turn := newTurn(s.ctx, s.nextTurnID, s.writeChan)
+	s.nextTurnID++
+	s.listening = turn
+	if err := s.prepareListening(); err != nil {
+		turn.Cancel()
+		return err
+	}
+	return nil
+}
+
+// prepareListening opens the listening turn's STT stream in eager push-to-talk mode.
+// Otherwise the turn waits: for its first audio in lazy mode,
+// and forever in hands-free mode, where the session's stream does the listening.
+// The caller must hold s.mu.
+func (s *Session) prepareListening() error {
+	if s.handsFree != nil || s.sttConnect != protocol.EagerSTT || s.listening.hasSTT() {
+		return nil
+	}
+	return s.listening.listen(s.providers.STT, s.sttOptions())
+}
+
+// sttOptions are the options for a push-to-talk turn's stream.
+// The caller must hold s.mu.
+func (s *Session) sttOptions() api.STTOptions {
+	return api.STTOptions{
+		InterimResults: true,
+		Listen:         s.listenOptions(),
+		Prewarm:        s.sttConnect == protocol.EagerSTT,
+	}
+}
+
+// listenOptions are the client's STT settings, on top of the persona's language.
+// The caller must hold s.mu.
+func (s *Session) listenOptions() protocol.ListenOptions {
+	return protocol.ListenOptions{Language: s.language}.Merge(s.listen)
+}
+
+// restartListening drops the listening turn and starts a fresh one.
+// The caller must hold s.mu.
+func (s *Session) restartListening() error {
+	s.listening.finish()
+	return s.startListening()
+}
+
+// takeListening hands over the listening turn, which now has its message,
+// and starts a fresh turn listening for the next one
+func (s *Session) takeListening() (*Turn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	turn := s.listening
+	if err := s.startListening(); err != nil {
+		turn.finish()
+		return nil, err
+	}
+	return turn, nil
+}
+
+func (s *Session) currentListening() *Turn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listening
+}
+
+// handleMessage acts on a control message from the client.
+// A returned error means the session can't go on.
+func (s *Session) handleMessage(message protocol.ClientMessage) error {
+	switch message.Type {
+	case protocol.UserText, protocol.AudioEnd:
+	case protocol.SessionStart:
+		return s.applySessionStart(message)
+	case protocol.Interrupt:
+		// The user started talking over the bot, cut the current reply off
+		log.Println("Received interrupt message, stopping the bot's turn")
+		s.interrupt()
+		return nil
+	default:
+		log.Printf("Ignoring message of unknown type %q", message.Type)
+		s.currentListening().reportError(badInput(fmt.Errorf("unknown message type %q", message.Type)))
+		return nil
+	}
+	if message.ConversationID == "" {
+		log.Println("Error: ConversationID is empty")
+		s.currentListening().reportError(badInput(fmt.Errorf("conversationId is empty")))
+		return nil
+	}
+
+	if message.Type == protocol.AudioEnd {
+		s.mu.Lock()
+		handsFree := s.handsFree
+		s.mu.Unlock()
+		if handsFree != nil {
+			// No need to wait for the pause, the user says they're done
+			handsFree.endUtterance()
+			return nil
+		}
+	}
+
+	// The listening turn now has its message, so it moves on to responding
+	// and a fresh turn starts listening for the next one
+	turn, err := s.takeListening()
+	if err != nil {
+		return err
+	}
+	s.startResponding(turn)
+
+	go func() {
+		defer s.doneResponding(turn)
+		userMessage := api.Transcript{Text: message.Text}
+		if message.Type == protocol.AudioEnd {
+			log.Println("Received audioEnd message, waiting for final transcripts")
+			transcript, err := turn.finishTranscript()
+			if err != nil {
+				log.Printf("Turn %d ended before its transcript was ready", turn.ID)
+				turn.finish()
+				return
+			}
+			userMessage = transcript
+			userMessage.Audio = turn.takeRecording()
+			log.Printf("Full transcript is %s", transcript.Text)
+		} else {
+			turn.stopListening()
+		}
+		log.Printf("Sending text to llama: %s", userMessage.Text)
+		turn.respond(s.providers, s.cfg, message.ConversationID, userMessage)
+	}()
+	return nil
+}
+
+// applySessionStart takes the listen options, persona, debate and mode from a session.start message.
+// New listen options replace the previous ones and apply to the next STT stream.
+// A persona is bound to the conversation, so it holds for every later turn, even on another connection.
+// So is a debate, and the session follows the phases of the conversation's debate if it has one going.
+// Failing to open the hands-free stream is reported to the client,
+// the session carries on in push-to-talk.
+func (s *Session) applySessionStart(message protocol.ClientMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch message.STTConnect {
+	case "":
+	case protocol.LazySTT, protocol.EagerSTT:
+		s.sttConnect = message.STTConnect
+	default:
+		s.listening.reportError(badInput(fmt.Errorf("unknown sttConnect %q", message.STTConnect)))
+		return nil
+	}
+	listenChanged := false
+	if message.Listen != nil {
+		if err := s.providers.STT.ValidateListen(*message.Listen); err != nil {
+			log.Println("Rejected listen options:", err)
+			s.listening.reportError(err)
+			return nil
+		}
+		s.listen = *message.Listen
+		listenChanged = true
+	}
+	if message.Persona != "" && message.ConversationID == "" {
+		s.listening.reportError(badInput(fmt.Errorf("conversationId is required to pick a persona")))
+		return nil
+	}
+	if message.Debate != nil && message.ConversationID == "" {
+		s.listening.reportError(badInput(fmt.Errorf("conversationId is required to start a debate")))
+		return nil
+	}
+	if message.ConversationID != "" {
+		language, err := bindPersona(message.ConversationID, message.Persona)
+		if err != nil {
+			log.Println("Failed to set the persona:", err)
+			s.listening.reportError(err)
+			return nil
+		}
+		if language != s.language {
+			s.language = language
+			listenChanged = true
+		}
+		if message.Debate != nil {
+			err = s.startDebate(message.ConversationID, *message.Debate)
+		} else {
+			err = s.watchDebate(message.ConversationID)
+		}
+		if err != nil {
+			log.Println("Failed to set up the debate:", err)
+			s.listening.reportError(err)
+			return nil
+		}
+	}
+
+	switch message.Mode {
+	case protocol.HandsFree:
+		if message.ConversationID == "" {
+			s.listening.reportError(badInput(fmt.Errorf("conversationId is required for hands-free mode")))
+			return nil
+		}
+		if s.handsFree != nil {
+			s.handsFree.conversationID = message.ConversationID
+			return nil
+		}
+		if err := s.startHandsFree(message.ConversationID); err != nil {
+			log.Println("Failed to start hands-free mode:", err)
+			s.listening.reportError(err)
+		}
+		return nil
+	case protocol.PushToTalk, "":
+		if s.handsFree != nil {
+			s.stopHandsFree()
+			// Hands-free turns have no stream of their own
+			return s.prepareListening()
+		}
+		if listenChanged && s.listening.hasSTT() {
+			// The listening turn's stream was opened with the old options
+			return s.restartListening()
+		}
+		return s.prepareListening()
+	default:
+		s.listening.reportError(badInput(fmt.Errorf("unknown mode %q", message.Mode)))
+		return nil
+	}
+}
+
+// bindPersona binds the conversation to personaID, if set,
+// and returns the STT language of the conversation's persona, empty if there's none
+func bindPersona(conversationID, personaID string) (string, error) {
+	if personaID != "" {
+		_, err := utils.GetPersona(personaID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", badInput(fmt.Errorf("unknown persona %q", personaID))
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := utils.BindPersona(conversationID, personaID); err != nil {
+			return "", err
+		}
+		log.Printf("Conversation %s now uses persona %s", conversationID, personaID)
+	}
+	persona, err := utils.GetConversationPersona(conversationID)
+	if err != nil || persona == nil {
+		return "", err
+	}
+	return persona.STTLanguage, nil
+}
+
+// respondTo hands the listening turn a message it got from somewhere
+// other than the client's own messages, e.g. the end of a hands-free utterance
+func (s *Session) respondTo(conversationID string, userMessage api.Transcript) {
+	turn, err := s.takeListening()
+	if err != nil {
+		// Same as a failure in the read loop, but Run is blocked reading and has to be woken up
+		s.fail(err)
+		s.conn.Close()
+		return
+	}
+	s.startResponding(turn)
+	go func() {
+		defer s.doneResponding(turn)
+		log.Printf("Sending text to llama: %s", userMessage.Text)
+		turn.respond(s.providers, s.cfg, conversationID, userMessage)
+	}()
+}
+
+// fail reports an error the session can't recover from.
+// Run returns right after, which tears down this session only.
+func (s *Session) fail(err error) {
+	log.Printf("Closing session: %v", err)
+	s.mu.Lock()
+	turnID := s.nextTurnID
+	s.mu.Unlock()
+	sendError(s.ctx, protocol.NewTurnWriter(turnID, s.writeChan), err)
+}
+
+// startResponding makes turn the one in flight. Only one bot reply plays at a time,
+// so whatever was still going is cancelled.
+func (s *Session) startResponding(turn *Turn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.responding != nil {
+		s.responding.Cancel()
+	}
+	s.responding = turn
+}
+
+func (s *Session) doneResponding(turn *Turn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.responding == turn {
+		s.responding = nil
+	}
+}
+
+// interrupt cancels the turn in flight, if there is one
+func (s *Session) interrupt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.responding != nil {
+		s.responding.Cancel()
+	}
+}
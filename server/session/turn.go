@@ -0,0 +1,280 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"go-websocket-server/api"
+	"go-websocket-server/config"
+	"go-websocket-server/protocol"
+	"go-websocket-server/utils"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// TurnState is where a turn is in its lifecycle.
+// A turn only ever moves forward: listening → transcribing → thinking → speaking → done.
+// Text turns skip transcribing, and any state can jump straight to done.
+type TurnState int
+
+const (
+	Listening    TurnState = iota // collecting the user's audio
+	Transcribing                  // the user stopped talking, waiting for the final transcript
+	Thinking                      // waiting for the LLM's first token
+	Speaking                      // streaming the reply's text and audio to the client
+	Done                          // finished, interrupted or torn down with the session
+)
+
+var turnStateNames = [...]string{"listening", "transcribing", "thinking", "speaking", "done"}
+
+func (s TurnState) String() string {
+	return turnStateNames[s]
+}
+
+// Turn is one exchange: the user's message and the bot's reply to it.
+// Everything the turn starts (STT stream, LLM request, TTS pipeline)
+// runs under its context, so cancelling the turn stops all of it.
+type Turn struct {
+	ID int
+
+	parent context.Context // the session's context, outlives the turn
+	ctx    context.Context
+	cancel context.CancelFunc
+	events *protocol.TurnWriter
+
+	transcript chan api.Transcript // full transcript, sent once the STT stream is finished
+
+	mu        sync.Mutex
+	stt       api.STTStream    // nil until listen, and for turns fed by a hands-free stream
+	recording *utils.Recording // the user's audio, nil until the first chunk or if the session doesn't record
+	state     TurnState
+
+	audioURL string // where the reply's audio was saved, set by respond for turn.done
+}
+
+// newTurn starts a turn in the listening state. It has no STT stream until listen is called.
+func newTurn(parent context.Context, id int, writeChan chan<- utils.WebSocketPacket) *Turn {
+	ctx, cancel := context.WithCancel(parent)
+	return &Turn{
+		ID:         id,
+		parent:     parent,
+		ctx:        ctx,
+		cancel:     cancel,
+		events:     protocol.NewTurnWriter(id, writeChan),
+		transcript: make(chan api.Transcript, 1),
+		state:      Listening,
+	}
+}
+
+// listen opens an STT stream for this turn and starts streaming its transcripts to the client
+func (t *Turn) listen(stt api.STTProvider, opts api.STTOptions) error {
+	sttStream, err := stt.OpenStream(t.ctx, opts)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.stt = sttStream
+	t.mu.Unlock()
+	go api.SendTranscriptToClient(t.ctx, sttStream.Events(), t.transcript, t.events)
+	// The STT stream never outlives its turn
+	go func() {
+		<-t.ctx.Done()
+		sttStream.Close()
+	}()
+	return nil
+}
+
+func (t *Turn) State() TurnState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+func (t *Turn) setState(state TurnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state <= t.state {
+		return
+	}
+	log.Printf("Turn %d: %s -> %s", t.ID, t.state, state)
+	t.state = state
+}
+
+func (t *Turn) sttStream() api.STTStream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stt
+}
+
+// hasSTT reports whether listen has opened the turn's stream
+func (t *Turn) hasSTT() bool {
+	return t.sttStream() != nil
+}
+
+// SendAudio forwards a slice of user audio to the turn's STT stream
+func (t *Turn) SendAudio(audio []byte) error {
+	stt := t.sttStream()
+	if stt == nil {
+		return &api.ProviderError{Kind: api.ErrBadInput, Provider: "the server", Err: fmt.Errorf("turn %d is not listening for audio", t.ID)}
+	}
+	return stt.SendAudio(audio)
+}
+
+// record keeps a copy of a chunk of the user's audio.
+// The turn's recording is started with newRecording on the first chunk.
+func (t *Turn) record(audio []byte, newRecording func() *utils.Recording) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.recording == nil {
+		t.recording = newRecording()
+	}
+	t.recording.Write(audio)
+}
+
+func (t *Turn) takeRecording() *utils.Recording {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	recording := t.recording
+	t.recording = nil
+	return recording
+}
+
+// finishTranscript tells the STT engine the user is done talking
+// and waits for the full transcript.
+func (t *Turn) finishTranscript() (api.Transcript, error) {
+	t.setState(Transcribing)
+	stt := t.sttStream()
+	if stt == nil {
+		// No audio was ever expected for this turn
+		return api.Transcript{}, nil
+	}
+	if err := stt.Finalize(); err != nil {
+		log.Println("Error finalizing transcription:", err)
+	}
+	// Wait for all transcripts to be processed and returned
+	select {
+	case transcript := <-t.transcript:
+		t.stopListening()
+		return transcript, nil
+	case <-t.ctx.Done():
+		return api.Transcript{}, t.ctx.Err()
+	}
+}
+
+// stopListening closes the STT stream, for turns that don't need any more audio
+func (t *Turn) stopListening() {
+	if stt := t.sttStream(); stt != nil {
+		stt.Close()
+	}
+}
+
+// respond runs the bot's side of the turn: the LLM's reply is streamed
+// to the client as text and, sentence by sentence, as audio.
+// The conversation's persona, if it's bound to one, picks the system prompt, model and voice.
+// In a debate, the bot is also told which side it argues and what the current phase asks of it.
+// Returns once the reply has been fully sent or the turn was cancelled.
+func (t *Turn) respond(providers Providers, cfg *config.Config, conversationID string, userMessage api.Transcript) {
+	defer t.finish()
+	t.setState(Thinking)
+
+	var systemPrompt string
+	var chatOptions api.ChatOptions
+	var ttsOptions api.TTSOptions
+	persona, err := utils.GetConversationPersona(conversationID)
+	if err != nil {
+		log.Printf("Failed to get the persona of conversation %s: %v", conversationID, err)
+	}
+	if persona != nil {
+		systemPrompt = persona.SystemPrompt
+		chatOptions = api.ChatOptions{Model: persona.Model, Temperature: persona.Temperature}
+		ttsOptions = api.TTSOptions{Voice: persona.Voice}
+	}
+	debate, err := debatePrompt(cfg, conversationID)
+	if err != nil {
+		log.Printf("Failed to get the debate of conversation %s: %v", conversationID, err)
+	}
+	if debate != "" {
+		if systemPrompt != "" {
+			systemPrompt += "\n\n"
+		}
+		systemPrompt += debate
+	}
+
+	botTextForClient := make(chan string)
+	botTextForTTS := make(chan string)
+	botAudio := make(chan api.SentenceChunk)
+	textToClient := make(chan string)
+	go t.watchFirstToken(botTextForClient, textToClient)
+	// One error event is enough if the TTS provider fails for every sentence
+	var ttsErrorOnce sync.Once
+	segmenter := utils.NewSegmenter(cfg.TTS.ChunkMin, cfg.TTS.ChunkMax, cfg.TTS.EagerFirst)
+	var normalizer *utils.Normalizer
+	if cfg.TTS.Normalize {
+		normalizer = utils.NewNormalizer(strings.Split(cfg.TTS.SpellOut, ","))
+	}
+	go api.BufferTextForTTS(t.ctx, providers.TTS, ttsOptions, segmenter, normalizer, cfg.TTS.RateLimit, botTextForTTS, botAudio, func(err error) {
+		ttsErrorOnce.Do(func() { t.reportError(err) })
+	})
+	// turn.done may only go out once both text and audio are through
+	var wg sync.WaitGroup
+	var sentAudio [][]byte
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		api.SendTextToClient(t.ctx, textToClient, t.events)
+	}()
+	go func() {
+		defer wg.Done()
+		sentAudio = api.SendAudioToClient(t.ctx, botAudio, providers.TTS.Format(), t.events)
+	}()
+
+	replyIndex, err := api.AskLlama(t.ctx, providers.LLM, chatOptions, systemPrompt, cfg.History.Window, conversationID, userMessage, botTextForClient, botTextForTTS)
+	if err != nil {
+		t.reportError(err)
+	}
+	wg.Wait()
+
+	// Keep what the user heard of the reply, so it can be replayed without synthesizing it again
+	if cfg.TTS.SaveAudio && replyIndex >= 0 && len(sentAudio) > 0 {
+		if err := api.SaveReplyAudio(conversationID, replyIndex, providers.TTS.Format(), sentAudio); err != nil {
+			log.Printf("Failed to save the audio of turn %d: %v", t.ID, err)
+		} else {
+			t.audioURL = fmt.Sprintf("/conversations/%s/messages/%d/audio", url.PathEscape(conversationID), replyIndex)
+		}
+	}
+}
+
+// reportError sends an error event for this turn
+func (t *Turn) reportError(err error) {
+	sendError(t.parent, t.events, err)
+}
+
+// watchFirstToken relays the bot's text and moves the turn to speaking
+// as soon as the first token comes back from the LLM
+func (t *Turn) watchFirstToken(inputChannel <-chan string, outputChannel chan<- string) {
+	defer close(outputChannel)
+	for text := range inputChannel {
+		t.setState(Speaking)
+		select {
+		case outputChannel <- text:
+		case <-t.ctx.Done():
+		}
+	}
+}
+
+// Cancel stops the turn wherever it is
+func (t *Turn) Cancel() {
+	t.cancel()
+}
+
+// finish marks the turn done and tells the client, noting whether it was cut off
+func (t *Turn) finish() {
+	interrupted := t.ctx.Err() != nil
+	t.setState(Done)
+	t.cancel()
+	payload := protocol.TurnDonePayload{Interrupted: interrupted, AudioURL: t.audioURL}
+	if err := t.events.Send(t.parent, protocol.TurnDone, payload); err != nil && t.parent.Err() == nil {
+		log.Printf("Error sending turn.done for turn %d: %v", t.ID, err)
+	}
+}
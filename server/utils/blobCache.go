@@ -0,0 +1,302 @@
+package utils
+
+import (
+	"container/list"
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// blobStore is where a BlobCache keeps its entries
+type blobStore interface {
+	load() ([]blobEntry, error) // every entry, least recently used first
+	read(key string) ([]byte, error)
+	write(key string, data []byte) error
+	touch(key string) error // marks the entry as just used, so the order survives a restart
+	remove(key string) error
+}
+
+type blobEntry struct {
+	key  string
+	size int64
+}
+
+// CacheStats is a snapshot of a BlobCache's counters
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"maxBytes"`
+}
+
+// BlobCache keeps blobs by key up to a total size, dropping the least recently used ones first
+type BlobCache struct {
+	store    blobStore
+	maxBytes int64
+
+	mu      sync.Mutex
+	order   *list.List               // of blobEntry, most recently used at the front
+	entries map[string]*list.Element // by key
+	stats   CacheStats
+}
+
+func newBlobCache(store blobStore, maxBytes int64) (*BlobCache, error) {
+	c := &BlobCache{
+		store:    store,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	entries, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		c.entries[entry.key] = c.order.PushFront(entry)
+		c.stats.Bytes += entry.size
+	}
+	// The limit may have gone down since last time
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+	return c, nil
+}
+
+// NewDiskBlobCache keeps the cache as one file per entry in dir
+func NewDiskBlobCache(dir string, maxBytes int64) (*BlobCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return newBlobCache(diskStore{dir}, maxBytes)
+}
+
+// NewSQLiteBlobCache keeps the cache in the blob_cache table of the database.
+// InitDB must have been called.
+func NewSQLiteBlobCache(maxBytes int64) (*BlobCache, error) {
+	_, err := DB.Exec(`
+        		CREATE TABLE IF NOT EXISTS blob_cache (
+        			key TEXT PRIMARY KEY,
+        			data BLOB,
+        			size INTEGER,
+        			last_used INTEGER
+        		)
+        	`)
+	if err != nil {
+		return nil, err
+	}
+	return newBlobCache(sqliteStore{}, maxBytes)
+}
+
+// Get returns the blob stored under key, ok is false on a miss.
+// The blob is read without holding the lock, so a slow disk doesn't hold up other sessions.
+func (c *BlobCache) Get(key string) (data []byte, ok bool, err error) {
+	c.mu.Lock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		c.mu.Unlock()
+		return nil, false, nil
+	}
+	c.mu.Unlock()
+
+	data, err = c.store.read(key)
+
+	c.mu.Lock()
+	current := c.entries[key] == element
+	if err != nil {
+		c.stats.Misses++
+		if !current {
+			// Evicted while we were reading it
+			c.mu.Unlock()
+			return nil, false, nil
+		}
+		// Gone from under us, e.g. someone cleaned up the directory
+		c.drop(element)
+		c.mu.Unlock()
+		return nil, false, err
+	}
+	c.stats.Hits++
+	if current {
+		c.order.MoveToFront(element)
+	}
+	c.mu.Unlock()
+
+	if current {
+		c.touch(key)
+	}
+	return data, true, nil
+}
+
+// Put stores data under key, evicting what it takes to stay under the size limit.
+// A blob bigger than the whole cache isn't stored.
+// Like Get, it writes the blob without holding the lock.
+func (c *BlobCache) Put(key string, data []byte) error {
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return nil
+	}
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		// Keys are content addressed, so it's the same blob
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		c.touch(key)
+		return nil
+	}
+	c.mu.Unlock()
+
+	if err := c.store.write(key, data); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		// Someone else stored it in the meantime
+		c.order.MoveToFront(element)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(blobEntry{key, size})
+	c.stats.Bytes += size
+	c.evict()
+	return nil
+}
+
+// touch marks the entry as just used in the store, so the order survives a restart
+func (c *BlobCache) touch(key string) {
+	if err := c.store.touch(key); err != nil {
+		log.Printf("Failed to update cache entry %s: %v", key, err)
+	}
+}
+
+// Stats returns the cache's counters
+func (c *BlobCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.MaxBytes = c.maxBytes
+	return stats
+}
+
+// evict drops least recently used entries until the cache fits.
+// The caller must hold c.mu.
+func (c *BlobCache) evict() {
+	for c.stats.Bytes > c.maxBytes {
+		element := c.order.Back()
+		entry := element.Value.(blobEntry)
+		if err := c.store.remove(entry.key); err != nil {
+			log.Printf("Failed to evict cache entry %s: %v", entry.key, err)
+		}
+		c.drop(element)
+		c.stats.Evictions++
+	}
+}
+
+// drop forgets an entry. The caller must hold c.mu.
+func (c *BlobCache) drop(element *list.Element) {
+	entry := c.order.Remove(element).(blobEntry)
+	delete(c.entries, entry.key)
+	c.stats.Bytes -= entry.size
+}
+
+// diskStore keeps every entry in its own file, the modification time says when it was last used
+type diskStore struct {
+	dir string
+}
+
+func (d diskStore) load() ([]blobEntry, error) {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []blobEntry
+	modTimes := make(map[string]time.Time)
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil || !info.Mode().IsRegular() || filepath.Ext(file.Name()) == ".tmp" {
+			continue
+		}
+		entries = append(entries, blobEntry{file.Name(), info.Size()})
+		modTimes[file.Name()] = info.ModTime()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return modTimes[entries[i].key].Before(modTimes[entries[j].key])
+	})
+	return entries, nil
+}
+
+func (d diskStore) read(key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(d.dir, key))
+}
+
+func (d diskStore) write(key string, data []byte) error {
+	// Write then rename, so a crash never leaves half an entry behind
+	path := filepath.Join(d.dir, key)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (d diskStore) touch(key string) error {
+	now := time.Now()
+	return os.Chtimes(filepath.Join(d.dir, key), now, now)
+}
+
+func (d diskStore) remove(key string) error {
+	return os.Remove(filepath.Join(d.dir, key))
+}
+
+// sqliteStore keeps entries in the blob_cache table
+type sqliteStore struct{}
+
+func (sqliteStore) load() ([]blobEntry, error) {
+	rows, err := DB.Query("SELECT key, size FROM blob_cache ORDER BY last_used")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []blobEntry
+	for rows.Next() {
+		var entry blobEntry
+		if err := rows.Scan(&entry.key, &entry.size); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (sqliteStore) read(key string) ([]byte, error) {
+	var data []byte
+	err := DB.QueryRow("SELECT data FROM blob_cache WHERE key = ?", key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, os.ErrNotExist
+	}
+	return data, err
+}
+
+func (sqliteStore) write(key string, data []byte) error {
+	_, err := DB.Exec(
+		"INSERT OR REPLACE INTO blob_cache (key, data, size, last_used) VALUES (?, ?, ?, ?)",
+		key, data, len(data), time.Now().UnixNano(),
+	)
+	return err
+}
+
+func (sqliteStore) touch(key string) error {
+	_, err := DB.Exec("UPDATE blob_cache SET last_used = ? WHERE key = ?", time.Now().UnixNano(), key)
+	return err
+}
+
+func (sqliteStore) remove(key string) error {
+	_, err := DB.Exec("DELETE FROM blob_cache WHERE key = ?", key)
+	return err
+}
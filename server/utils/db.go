@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
+	"strings"
 )
 
 var DB *sql.DB
@@ -14,6 +15,16 @@ type MessageObj struct {
 	Role    string `json:"role"`
 }
 
+// Word is one recognized word of a user transcript.
+// Start and End are in seconds into the STT stream.
+type Word struct {
+	Word       string  `json:"word"`
+	Start      float64 `json:"start"`
+	End        float64 `json:"end"`
+	Confidence float64 `json:"confidence"`
+	Speaker    *int    `json:"speaker,omitempty"` // only when the STT engine tells speakers apart
+}
+
 func InitDB(dbPath string) {
 	var err error
 	DB, err = sql.Open("sqlite3", dbPath)
@@ -34,6 +45,107 @@ func InitDB(dbPath string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Words of user messages that came from speech, in the order they were said
+	_, err = DB.Exec(`
+        		CREATE TABLE IF NOT EXISTS message_words (
+        			conversation_id TEXT,
+        			message_index INTEGER,
+        			word_index INTEGER,
+        			word TEXT,
+        			start_time REAL,
+        			end_time REAL,
+        			confidence REAL,
+        			speaker INTEGER,
+        			PRIMARY KEY (conversation_id, message_index, word_index),
+        			FOREIGN KEY (conversation_id, message_index) REFERENCES messages (conversation_id, message_index)
+        		)
+        	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Databases from before diarization
+	if err := addColumn("message_words", "speaker", "INTEGER"); err != nil {
+		log.Fatal(err)
+	}
+	// What the bot's replies sounded like, when the server keeps their TTS audio
+	_, err = DB.Exec(`
+        		CREATE TABLE IF NOT EXISTS message_audio (
+        			conversation_id TEXT,
+        			message_index INTEGER,
+        			mime_type TEXT,
+        			audio BLOB,
+        			PRIMARY KEY (conversation_id, message_index),
+        			FOREIGN KEY (conversation_id, message_index) REFERENCES messages (conversation_id, message_index)
+        		)
+        	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Where the recording of a spoken user message is, when the server records audio
+	if err := addColumn("messages", "audio_path", "TEXT"); err != nil {
+		log.Fatal(err)
+	}
+	// Who the bot is: its system prompt, model and voice
+	_, err = DB.Exec(`
+        		CREATE TABLE IF NOT EXISTS personas (
+        			id TEXT PRIMARY KEY,
+        			system_prompt TEXT,
+        			model TEXT,
+        			temperature REAL,
+        			voice TEXT,
+        			stt_language TEXT
+        		)
+        	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Settings of a conversation that hold for all of its messages
+	_, err = DB.Exec(`
+        		CREATE TABLE IF NOT EXISTS conversations (
+        			conversation_id TEXT PRIMARY KEY,
+        			persona_id TEXT REFERENCES personas (id)
+        		)
+        	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Where the debate of a conversation is, if it's having one
+	_, err = DB.Exec(`
+        		CREATE TABLE IF NOT EXISTS debates (
+        			conversation_id TEXT PRIMARY KEY,
+        			resolution TEXT,
+        			user_side TEXT,
+        			phase TEXT,
+        			phase_ends_at INTEGER
+        		)
+        	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// addColumn adds a column to a table created by an older version, if it isn't there yet
+func addColumn(table, column, definition string) error {
+	rows, err := DB.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = DB.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
 }
 
 func SaveMessage(conversationID string, messageIndex int, role, name,
@@ -48,6 +160,81 @@ func SaveMessage(conversationID string, messageIndex int, role, name,
 	)
 	return err
 }
+
+// SetMessageAudioPath records where the audio of an already saved message is
+func SetMessageAudioPath(conversationID string, messageIndex int, path string) error {
+	_, err := DB.Exec(
+		"UPDATE messages SET audio_path = ? WHERE conversation_id = ? AND message_index = ?",
+		path, conversationID, messageIndex,
+	)
+	return err
+}
+
+// SaveMessageAudio stores the synthesized audio of an already saved message
+func SaveMessageAudio(conversationID string, messageIndex int, mimeType string, audio []byte) error {
+	_, err := DB.Exec(
+		"INSERT OR REPLACE INTO message_audio (conversation_id, message_index, mime_type, audio) VALUES (?, ?, ?, ?)",
+		conversationID, messageIndex, mimeType, audio,
+	)
+	return err
+}
+
+// GetMessageAudio returns the audio of a message and its MIME type.
+// The error is sql.ErrNoRows if the message has no audio.
+func GetMessageAudio(conversationID string, messageIndex int) (mimeType string, audio []byte, err error) {
+	err = DB.QueryRow(
+		"SELECT mime_type, audio FROM message_audio WHERE conversation_id = ? AND message_index = ?",
+		conversationID, messageIndex,
+	).Scan(&mimeType, &audio)
+	return mimeType, audio, err
+}
+
+// SaveMessageWords stores the words of an already saved message
+func SaveMessageWords(conversationID string, messageIndex int, words []Word) error {
+	if len(words) == 0 {
+		return nil
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, word := range words {
+		_, err := tx.Exec(
+			"INSERT INTO message_words (conversation_id, message_index, word_index, word, start_time, end_time, confidence, speaker) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			conversationID, messageIndex, i, word.Word, word.Start, word.End, word.Confidence, word.Speaker,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetMessageWords returns the words of a message, empty for typed messages
+func GetMessageWords(conversationID string, messageIndex int) ([]Word, error) {
+	rows, err := DB.Query(`
+                SELECT word, start_time, end_time, confidence, speaker
+                FROM message_words
+                WHERE conversation_id = ? AND message_index = ?
+                ORDER BY word_index
+            `, conversationID, messageIndex)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var words []Word
+	for rows.Next() {
+		var word Word
+		if err := rows.Scan(&word.Word, &word.Start, &word.End, &word.Confidence, &word.Speaker); err != nil {
+			return nil, err
+		}
+		words = append(words, word)
+	}
+	return words, rows.Err()
+}
+
 func GetNextMessageIndex(conversationID string) (int, error) {
 	var maxIndex int
 	err := DB.QueryRow("SELECT COALESCE(MAX(message_index), -1) FROM messages WHERE conversation_id = ?", conversationID).Scan(&maxIndex)
@@ -57,14 +244,20 @@ func GetNextMessageIndex(conversationID string) (int, error) {
 	return maxIndex + 1, nil
 }
 
-func GetConversationHistory(conversationID string) ([]MessageObj, error) {
+// isSpeakerSegment is for user messages split by speaker, named speaker_N instead of user
+func isSpeakerSegment(msg MessageObj) bool {
+	return msg.Role == "user" && strings.HasPrefix(msg.Name, "speaker_")
+}
+
+// GetConversationHistory returns up to window of the latest messages, oldest first
+func GetConversationHistory(conversationID string, window int) ([]MessageObj, error) {
 	rows, err := DB.Query(`
                 SELECT role, name, content
                 FROM messages
                 WHERE conversation_id = ?
                 ORDER BY message_index DESC
-                LIMIT 6
-            `, conversationID)
+                LIMIT ?
+            `, conversationID, window)
 	if err != nil {
 		return nil, err
 	}
@@ -93,10 +286,16 @@ func GetConversationHistory(conversationID string) ([]MessageObj, error) {
 
 		// Then ensure alternating messages for the rest
 		userTurn := messages[len(messages)-1].Role != "user"
-		for i := len(messages) - 2; i >= 0 && len(result) < 6; i-- {
+		previous := len(messages) - 1 // index of the last message added
+		for i := len(messages) - 2; i >= 0 && len(result) < window; i-- {
 			if (userTurn && messages[i].Role == "user") || (!userTurn && messages[i].Role == "assistant") {
 				result = append([]MessageObj{messages[i]}, result...)
 				userTurn = !userTurn
+				previous = i
+			} else if previous == i+1 && isSpeakerSegment(messages[i]) && isSpeakerSegment(messages[previous]) {
+				// Several people spoke in the same turn, keep all of what they said
+				result = append([]MessageObj{messages[i]}, result...)
+				previous = i
 			}
 		}
 	}
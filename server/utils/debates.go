@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Debate is a conversation where the user argues one side of a resolution and the bot the other.
+// Phase is the phase the debate is in, PhaseEndsAt when it runs out of time.
+type Debate struct {
+	ConversationID string
+	Resolution     string
+	UserSide       string // for or against
+	Phase          string
+	PhaseEndsAt    time.Time
+}
+
+// SaveDebate starts a debate in the conversation, replacing the one it had
+func SaveDebate(d Debate) error {
+	_, err := DB.Exec(
+		"INSERT OR REPLACE INTO debates (conversation_id, resolution, user_side, phase, phase_ends_at) VALUES (?, ?, ?, ?, ?)",
+		d.ConversationID, d.Resolution, d.UserSide, d.Phase, d.PhaseEndsAt.UnixMilli(),
+	)
+	return err
+}
+
+// GetDebate returns the conversation's debate, nil if it never had one
+func GetDebate(conversationID string) (*Debate, error) {
+	d := Debate{ConversationID: conversationID}
+	var endsAt int64
+	err := DB.QueryRow(
+		"SELECT resolution, user_side, phase, phase_ends_at FROM debates WHERE conversation_id = ?", conversationID,
+	).Scan(&d.Resolution, &d.UserSide, &d.Phase, &endsAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.PhaseEndsAt = time.UnixMilli(endsAt)
+	return &d, nil
+}
+
+// AdvanceDebate moves the debate from the phase it was in to d's.
+// Nothing changes if someone else moved it first, e.g. another connection to the same conversation,
+// or the debate was started over: ok is false and the caller should read it again.
+func AdvanceDebate(from, d Debate) (ok bool, err error) {
+	result, err := DB.Exec(
+		"UPDATE debates SET phase = ?, phase_ends_at = ? WHERE conversation_id = ? AND phase = ? AND phase_ends_at = ?",
+		d.Phase, d.PhaseEndsAt.UnixMilli(), from.ConversationID, from.Phase, from.PhaseEndsAt.UnixMilli(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Pronunciation tells the TTS engine how to say a word, e.g. a product name it gets wrong.
+// Respelling is plain text that sounds right, for any engine.
+// Phoneme is a transcription in Alphabet (ipa or x-sampa), for engines that read SSML.
+type Pronunciation struct {
+	Word       string `json:"word"`
+	Respelling string `json:"respelling,omitempty"`
+	Phoneme    string `json:"phoneme,omitempty"`
+	Alphabet   string `json:"alphabet,omitempty"`
+}
+
+// Validate checks a pronunciation before it's stored, and fills in the default alphabet
+func (p *Pronunciation) Validate() error {
+	p.Word = strings.TrimSpace(p.Word)
+	if p.Word == "" {
+		return errors.New("word is required")
+	}
+	if p.Respelling == "" && p.Phoneme == "" {
+		return errors.New("a respelling or a phoneme is required")
+	}
+	if p.Phoneme == "" {
+		p.Alphabet = ""
+		return nil
+	}
+	switch p.Alphabet {
+	case "":
+		p.Alphabet = "ipa"
+	case "ipa", "x-sampa":
+	default:
+		return errors.New("alphabet must be ipa or x-sampa")
+	}
+	return nil
+}
+
+// Lexicon is the deployment's pronunciation dictionary, kept in the pronunciations table.
+// Every change goes to the database and takes effect on the next sentence, no restart needed.
+// Reload picks up changes made to the table directly.
+// It's applied to the text after the Normalizer, so words must be written the way the normalizer
+// leaves them: "twenty twenty-four" rather than 2024, "S Q L" rather than SQL if it's spelled out.
+type Lexicon struct {
+	mu      sync.RWMutex
+	entries map[string]Pronunciation // by lowercased word
+	pattern *regexp.Regexp           // matches any word in entries, nil when there are none
+}
+
+// NewLexicon loads the lexicon from the database. InitDB must have been called.
+func NewLexicon() (*Lexicon, error) {
+	_, err := DB.Exec(`
+        		CREATE TABLE IF NOT EXISTS pronunciations (
+        			word TEXT PRIMARY KEY COLLATE NOCASE,
+        			respelling TEXT,
+        			phoneme TEXT,
+        			alphabet TEXT
+        		)
+        	`)
+	if err != nil {
+		return nil, err
+	}
+	l := &Lexicon{}
+	return l, l.Reload()
+}
+
+// Reload reads the whole lexicon from the database again
+func (l *Lexicon) Reload() error {
+	rows, err := DB.Query("SELECT word, respelling, phoneme, alphabet FROM pronunciations")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	entries := make(map[string]Pronunciation)
+	for rows.Next() {
+		// Rows edited by hand may have NULLs
+		var p Pronunciation
+		var respelling, phoneme, alphabet sql.NullString
+		if err := rows.Scan(&p.Word, &respelling, &phoneme, &alphabet); err != nil {
+			return err
+		}
+		p.Respelling, p.Phoneme, p.Alphabet = respelling.String, phoneme.String, alphabet.String
+		entries[strings.ToLower(p.Word)] = p
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.swap(entries)
+	return nil
+}
+
+// Entries returns every pronunciation, sorted by word
+func (l *Lexicon) Entries() []Pronunciation {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entries := make([]Pronunciation, 0, len(l.entries))
+	for _, p := range l.entries {
+		entries = append(entries, p)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.ToLower(entries[i].Word) < strings.ToLower(entries[j].Word)
+	})
+	return entries
+}
+
+// Set adds a pronunciation, or replaces the one for the same word
+func (l *Lexicon) Set(p Pronunciation) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := DB.Exec(
+		"INSERT OR REPLACE INTO pronunciations (word, respelling, phoneme, alphabet) VALUES (?, ?, ?, ?)",
+		p.Word, p.Respelling, p.Phoneme, p.Alphabet,
+	)
+	if err != nil {
+		return err
+	}
+	entries := l.copyEntries()
+	entries[strings.ToLower(p.Word)] = p
+	l.swap(entries)
+	return nil
+}
+
+// Remove deletes the pronunciation of word, ok is false if there was none
+func (l *Lexicon) Remove(word string) (ok bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result, err := DB.Exec("DELETE FROM pronunciations WHERE word = ?", word)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	entries := l.copyEntries()
+	delete(entries, strings.ToLower(word))
+	l.swap(entries)
+	return true, nil
+}
+
+// Apply rewrites text with the lexicon's pronunciations.
+// Without SSML, words with a respelling are replaced by it and the rest is left alone.
+// With SSML, the text is escaped and wrapped in <speak>, words with a phoneme get a <phoneme> tag
+// and words with only a respelling a <sub> tag.
+func (l *Lexicon) Apply(text string, ssml bool) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var out strings.Builder
+	write := func(s string) {
+		if ssml {
+			s = html.EscapeString(s)
+		}
+		out.WriteString(s)
+	}
+	if ssml {
+		out.WriteString("<speak>")
+	}
+	last := 0
+	if l.pattern != nil {
+		for _, span := range l.pattern.FindAllStringIndex(text, -1) {
+			word := text[span[0]:span[1]]
+			p := l.entries[strings.ToLower(word)]
+			write(text[last:span[0]])
+			switch {
+			case ssml && p.Phoneme != "":
+				out.WriteString(`<phoneme alphabet="` + html.EscapeString(p.Alphabet) + `" ph="` + html.EscapeString(p.Phoneme) + `">` + html.EscapeString(word) + "</phoneme>")
+			case ssml:
+				out.WriteString(`<sub alias="` + html.EscapeString(p.Respelling) + `">` + html.EscapeString(word) + "</sub>")
+			case p.Respelling != "":
+				out.WriteString(p.Respelling)
+			default:
+				out.WriteString(word)
+			}
+			last = span[1]
+		}
+	}
+	write(text[last:])
+	if ssml {
+		out.WriteString("</speak>")
+	}
+	return out.String()
+}
+
+// copyEntries returns a copy of the entries to change. The caller must hold l.mu.
+func (l *Lexicon) copyEntries() map[string]Pronunciation {
+	entries := make(map[string]Pronunciation, len(l.entries)+1)
+	for word, p := range l.entries {
+		entries[word] = p
+	}
+	return entries
+}
+
+// swap makes entries the lexicon and compiles the pattern that finds them. The caller must hold l.mu.
+func (l *Lexicon) swap(entries map[string]Pronunciation) {
+	l.entries = entries
+	l.pattern = nil
+	if len(entries) == 0 {
+		return
+	}
+	words := make([]string, 0, len(entries))
+	for word := range entries {
+		words = append(words, word)
+	}
+	// Longest first, so a phrase wins over a word in it
+	sort.Slice(words, func(i, j int) bool { return len(words[i]) > len(words[j]) })
+	alternatives := make([]string, len(words))
+	for i, word := range words {
+		// Only match whole words. \b only knows ASCII, so words like C# or Zoë match inside others too.
+		alternative := regexp.QuoteMeta(word)
+		if first := word[0]; first < 0x80 && isWordRune(rune(first)) {
+			alternative = `\b` + alternative
+		}
+		if last := word[len(word)-1]; last < 0x80 && isWordRune(rune(last)) {
+			alternative += `\b`
+		}
+		alternatives[i] = alternative
+	}
+	l.pattern = regexp.MustCompile(`(?i)(?:` + strings.Join(alternatives, "|") + `)`)
+}
@@ -0,0 +1,539 @@
+package utils
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Normalizer rewrites the chunks of a reply the way they should be read aloud.
+// Markdown is stripped, code blocks are announced instead of read out, emoji are dropped,
+// links are read as their site, acronyms from the spell out list are read letter by letter,
+// and numbers, dates, times, prices and units are written out in words.
+// Code blocks span several chunks, so use one Normalizer per reply and feed it the chunks in order.
+type Normalizer struct {
+	spellOut map[string]bool
+	inCode   bool
+}
+
+// NewNormalizer returns a Normalizer that spells out the given acronyms, e.g. API becomes A P I
+func NewNormalizer(spellOut []string) *Normalizer {
+	n := &Normalizer{spellOut: make(map[string]bool)}
+	for _, acronym := range spellOut {
+		if acronym = strings.ToUpper(strings.TrimSpace(acronym)); acronym != "" {
+			n.spellOut[acronym] = true
+		}
+	}
+	return n
+}
+
+// Normalize returns text as it should be spoken, empty if there's nothing to say.
+// A nil Normalizer returns text as it is.
+func (n *Normalizer) Normalize(text string) string {
+	if n == nil {
+		return text
+	}
+	var spoken []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = n.line(line); line != "" {
+			spoken = append(spoken, line)
+		}
+	}
+	return strings.Join(spoken, " ")
+}
+
+func (n *Normalizer) line(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+		n.inCode = !n.inCode
+		if !n.inCode {
+			return ""
+		}
+		// ```go {linenos} is Go code
+		if language := strings.Fields(strings.Trim(trimmed, "`~ ")); len(language) > 0 {
+			return "Here's some " + language[0] + " code."
+		}
+		return "Here's some code."
+	}
+	if n.inCode {
+		return ""
+	}
+	text := stripMarkdown(trimmed)
+	text = stripEmoji(text)
+	text = speakURLs(text)
+	text = n.spellAcronyms(text)
+	text = expandDates(text)
+	text = expandTimes(text)
+	text = expandMoney(text)
+	text = expandUnits(text)
+	text = expandNumbers(text)
+	return strings.Join(strings.Fields(text), " ")
+}
+
+var (
+	headingRegex   = regexp.MustCompile(`^#{1,6}\s+`)
+	quoteRegex     = regexp.MustCompile(`^(>\s*)+`)
+	ruleRegex      = regexp.MustCompile(`^([-*_]\s*){3,}$`)
+	bulletRegex    = regexp.MustCompile(`^[-*+•]\s+`)
+	tableRuleRegex = regexp.MustCompile(`^\|?[\s:|-]+\|?$`)
+	imageRegex     = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	linkRegex      = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	boldRegex      = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	italicRegex    = regexp.MustCompile(`(^|[^\w*])\*([^*\s][^*]*)\*([^\w*]|$)`)
+	underlineRegex = regexp.MustCompile(`(^|\W)_([^_\s][^_]*)_(\W|$)`)
+	strikeRegex    = regexp.MustCompile(`~~([^~]+)~~`)
+	inlineCode     = regexp.MustCompile("`([^`]*)`")
+)
+
+// stripMarkdown keeps the words of one line of markdown and drops the formatting
+func stripMarkdown(line string) string {
+	if ruleRegex.MatchString(line) {
+		return ""
+	}
+	if strings.HasPrefix(line, "|") {
+		if tableRuleRegex.MatchString(line) {
+			return ""
+		}
+		// Read a table row as a list
+		var cells []string
+		for _, cell := range strings.Split(strings.Trim(line, "|"), "|") {
+			cells = append(cells, strings.TrimSpace(cell))
+		}
+		line = strings.Join(cells, ", ")
+	}
+	line = headingRegex.ReplaceAllString(line, "")
+	line = quoteRegex.ReplaceAllString(line, "")
+	line = bulletRegex.ReplaceAllString(line, "")
+	line = imageRegex.ReplaceAllString(line, "$1")
+	line = linkRegex.ReplaceAllString(line, "$1")
+	line = inlineCode.ReplaceAllString(line, "$1")
+	line = boldRegex.ReplaceAllString(line, "$1$2")
+	line = italicRegex.ReplaceAllString(line, "$1$2$3")
+	line = underlineRegex.ReplaceAllString(line, "$1$2$3")
+	line = strikeRegex.ReplaceAllString(line, "$1")
+	// Whatever's left over from formatting that was cut across chunks
+	return strings.NewReplacer("**", "", "__", "", "`", "").Replace(line)
+}
+
+func stripEmoji(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 0x1F000 && r <= 0x1FAFF, // emoticons, pictographs, flags...
+			r >= 0x2600 && r <= 0x27BF,   // symbols and dingbats
+			r >= 0x2B00 && r <= 0x2BFF,   // arrows and stars
+			r >= 0xE0020 && r <= 0xE007F, // tags
+			r == 0xFE0F, r == 0x200D:     // emoji variation selector and zero width joiner
+			return -1
+		}
+		return r
+	}, text)
+}
+
+var urlRegex = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>()\[\]]+`)
+
+// speakURLs replaces links with the site they point to, e.g. https://go.dev/doc/ becomes go dot dev
+func speakURLs(text string) string {
+	return urlRegex.ReplaceAllStringFunc(text, func(url string) string {
+		// The end of the sentence isn't part of the link
+		trimmed := strings.TrimRight(url, ".,;:!?'\"")
+		host := strings.TrimLeft(trimmed[strings.Index(trimmed, "//")+1:], "/")
+		host = strings.TrimPrefix(strings.ToLower(host), "www.")
+		if i := strings.IndexAny(host, "/?#:"); i >= 0 {
+			host = host[:i]
+		}
+		return strings.ReplaceAll(host, ".", " dot ") + url[len(trimmed):]
+	})
+}
+
+var acronymRegex = regexp.MustCompile(`\b([A-Z][A-Z0-9&]*[A-Z0-9])(s?)\b`)
+
+func (n *Normalizer) spellAcronyms(text string) string {
+	return acronymRegex.ReplaceAllStringFunc(text, func(word string) string {
+		match := acronymRegex.FindStringSubmatch(word)
+		if !n.spellOut[match[1]] {
+			return word
+		}
+		letters := strings.Split(match[1], "")
+		return strings.Join(letters, " ") + match[2]
+	})
+}
+
+var months = []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}
+
+// monthNames matches a month, written out or abbreviated
+const monthNames = `(Jan(?:uary)?|Feb(?:ruary)?|Mar(?:ch)?|Apr(?:il)?|May|June?|July?|Aug(?:ust)?|Sep(?:t(?:ember)?)?|Oct(?:ober)?|Nov(?:ember)?|Dec(?:ember)?)`
+
+var (
+	isoDateRegex   = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+	monthDayRegex  = regexp.MustCompile(`\b` + monthNames + `\.? (\d{1,2})(?:st|nd|rd|th)?\b(?:,? (\d{4})\b)?`)
+	dayMonthRegex  = regexp.MustCompile(`\b(\d{1,2})(?:st|nd|rd|th)? ` + monthNames + `\b(?:,? (\d{4})\b)?`)
+	yearAfterRegex = regexp.MustCompile(`(?i)\b(in|since|by|from|until|year) (\d{4})\b`)
+)
+
+func month(name string) string {
+	for _, month := range months {
+		if strings.HasPrefix(month, name) {
+			return month
+		}
+	}
+	return name
+}
+
+// expandDates reads dates like 2024-03-15, March 15, 2024 and 15 March 2024, and years after words like in
+func expandDates(text string) string {
+	text = isoDateRegex.ReplaceAllStringFunc(text, func(date string) string {
+		match := isoDateRegex.FindStringSubmatch(date)
+		m, _ := strconv.Atoi(match[2])
+		day, _ := strconv.Atoi(match[3])
+		if m < 1 || m > 12 || day < 1 || day > 31 {
+			return date
+		}
+		return months[m-1] + " " + ordinalWords(int64(day)) + ", " + yearWords(match[1])
+	})
+	text = monthDayRegex.ReplaceAllStringFunc(text, func(date string) string {
+		match := monthDayRegex.FindStringSubmatch(date)
+		day, _ := strconv.Atoi(match[2])
+		if day < 1 || day > 31 {
+			return date
+		}
+		spoken := month(match[1]) + " " + ordinalWords(int64(day))
+		if match[3] != "" {
+			spoken += ", " + yearWords(match[3])
+		}
+		return spoken
+	})
+	text = dayMonthRegex.ReplaceAllStringFunc(text, func(date string) string {
+		match := dayMonthRegex.FindStringSubmatch(date)
+		day, _ := strconv.Atoi(match[1])
+		if day < 1 || day > 31 {
+			return date
+		}
+		spoken := "the " + ordinalWords(int64(day)) + " of " + month(match[2])
+		if match[3] != "" {
+			spoken += ", " + yearWords(match[3])
+		}
+		return spoken
+	})
+	return yearAfterRegex.ReplaceAllStringFunc(text, func(phrase string) string {
+		match := yearAfterRegex.FindStringSubmatch(phrase)
+		return match[1] + " " + yearWords(match[2])
+	})
+}
+
+var timeRegex = regexp.MustCompile(`(?i)\b(\d{1,2}):(\d{2})(?:\s?([ap])\.?m\b)?`)
+
+// expandTimes reads 9:05 as nine oh five and 3:00 pm as three P M
+func expandTimes(text string) string {
+	return timeRegex.ReplaceAllStringFunc(text, func(clock string) string {
+		match := timeRegex.FindStringSubmatch(clock)
+		hour, _ := strconv.Atoi(match[1])
+		minute, _ := strconv.Atoi(match[2])
+		if hour > 23 || minute > 59 {
+			return clock
+		}
+		spoken := numberWords(int64(hour))
+		switch {
+		case minute == 0 && match[3] == "":
+			spoken += " o'clock"
+		case minute == 0:
+		case minute < 10:
+			spoken += " oh " + numberWords(int64(minute))
+		default:
+			spoken += " " + numberWords(int64(minute))
+		}
+		if match[3] != "" {
+			spoken += " " + strings.ToUpper(match[3]) + " M"
+		}
+		return spoken
+	})
+}
+
+type currency struct {
+	one, many   string
+	cent, cents string
+}
+
+var currencies = map[string]currency{
+	"$": {"dollar", "dollars", "cent", "cents"},
+	"€": {"euro", "euros", "cent", "cents"},
+	"£": {"pound", "pounds", "penny", "pence"},
+	"¥": {"yen", "yen", "", ""},
+	"₹": {"rupee", "rupees", "paisa", "paise"},
+}
+
+var (
+	moneyRegex   = regexp.MustCompile(`([$€£¥₹])\s?(\d[\d,]*(?:\.\d+)?)(?:\s?(thousand|million|billion|trillion|[kK]|[mM]|bn|[bB])\b)?`)
+	percentRegex = regexp.MustCompile(`(\d[\d,]*(?:\.\d+)?)\s?%`)
+	scales       = map[string]string{"k": "thousand", "K": "thousand", "m": "million", "M": "million", "bn": "billion", "b": "billion", "B": "billion"}
+)
+
+// expandMoney reads $1.50 as one dollar and fifty cents, €2.5M as two point five million euros and 50% as fifty percent
+func expandMoney(text string) string {
+	text = moneyRegex.ReplaceAllStringFunc(text, func(price string) string {
+		match := moneyRegex.FindStringSubmatch(price)
+		names := currencies[match[1]]
+		amount := strings.ReplaceAll(match[2], ",", "")
+		if scale := match[3]; scale != "" {
+			if word, ok := scales[scale]; ok {
+				scale = word
+			}
+			return amount + " " + scale + " " + names.many
+		}
+		whole, fraction, _ := strings.Cut(amount, ".")
+		name := names.many
+		if whole == "1" {
+			name = names.one
+		}
+		if fraction == "" || strings.Trim(fraction, "0") == "" {
+			return whole + " " + name
+		}
+		if len(fraction) != 2 || names.cents == "" {
+			return amount + " " + names.many
+		}
+		cents := strings.TrimLeft(fraction, "0")
+		centName := names.cents
+		if cents == "1" {
+			centName = names.cent
+		}
+		if whole == "0" {
+			return cents + " " + centName
+		}
+		return whole + " " + name + " and " + cents + " " + centName
+	})
+	return percentRegex.ReplaceAllString(text, "$1 percent")
+}
+
+type unit struct {
+	one, many string
+}
+
+var units = map[string]unit{
+	"km/h": {"kilometer per hour", "kilometers per hour"},
+	"kph":  {"kilometer per hour", "kilometers per hour"},
+	"mph":  {"mile per hour", "miles per hour"},
+	"km":   {"kilometer", "kilometers"},
+	"cm":   {"centimeter", "centimeters"},
+	"mm":   {"millimeter", "millimeters"},
+	"mi":   {"mile", "miles"},
+	"ft":   {"foot", "feet"},
+	"kg":   {"kilogram", "kilograms"},
+	"mg":   {"milligram", "milligrams"},
+	"lb":   {"pound", "pounds"},
+	"lbs":  {"pound", "pounds"},
+	"oz":   {"ounce", "ounces"},
+	"ml":   {"milliliter", "milliliters"},
+	"mL":   {"milliliter", "milliliters"},
+	"ms":   {"millisecond", "milliseconds"},
+	"KB":   {"kilobyte", "kilobytes"},
+	"MB":   {"megabyte", "megabytes"},
+	"GB":   {"gigabyte", "gigabytes"},
+	"TB":   {"terabyte", "terabytes"},
+	"Hz":   {"hertz", "hertz"},
+	"kHz":  {"kilohertz", "kilohertz"},
+	"MHz":  {"megahertz", "megahertz"},
+	"GHz":  {"gigahertz", "gigahertz"},
+	"W":    {"watt", "watts"},
+	"kW":   {"kilowatt", "kilowatts"},
+	"kWh":  {"kilowatt hour", "kilowatt hours"},
+	"°C":   {"degree Celsius", "degrees Celsius"},
+	"°F":   {"degree Fahrenheit", "degrees Fahrenheit"},
+	"°":    {"degree", "degrees"},
+}
+
+// Longest first, so kWh isn't read as kW and h. Units that are also common words, like in, aren't here.
+var unitRegex = regexp.MustCompile(`(\d[\d,]*(?:\.\d+)?)\s?(km/h|kph|mph|kWh|kHz|MHz|GHz|lbs|km|cm|mm|mi|ft|kg|mg|lb|oz|ml|mL|ms|KB|MB|GB|TB|Hz|kW|W|°C|°F|°)([^\p{L}\p{N}]|$)`)
+
+// expandUnits reads 5 km as 5 kilometers, the number itself is left to expandNumbers
+func expandUnits(text string) string {
+	return unitRegex.ReplaceAllStringFunc(text, func(quantity string) string {
+		match := unitRegex.FindStringSubmatch(quantity)
+		name := units[match[2]].many
+		if match[1] == "1" {
+			name = units[match[2]].one
+		}
+		return match[1] + " " + name + match[3]
+	})
+}
+
+var (
+	ordinalRegex = regexp.MustCompile(`\b(\d+)(?:st|nd|rd|th)\b`)
+	phoneRegex   = regexp.MustCompile(`(?:\(\d{3}\) ?|\b\d{3}[-.])?\b\d{3}-\d{4}\b`)
+	digitsRegex  = regexp.MustCompile(`\d+`)
+	numberRegex  = regexp.MustCompile(`\d[\d,.]*\d|\d`)
+	groupedRegex = regexp.MustCompile(`^\d{1,3}(,\d{3})+(\.\d+)?$`)
+	plainRegex   = regexp.MustCompile(`^\d+(\.\d+)?$`)
+)
+
+// expandNumbers writes out every number left: 1,250 is one thousand two hundred fifty,
+// 3.14 is three point one four, 21st is twenty-first, -4 is minus four
+// and phone numbers like 555-1234 are read digit by digit
+func expandNumbers(text string) string {
+	text = phoneRegex.ReplaceAllStringFunc(text, func(phone string) string {
+		groups := digitsRegex.FindAllString(phone, -1)
+		for i, group := range groups {
+			groups[i] = digitWords(group)
+		}
+		return strings.Join(groups, ", ")
+	})
+	text = ordinalRegex.ReplaceAllStringFunc(text, func(ordinal string) string {
+		digits := ordinalRegex.FindStringSubmatch(ordinal)[1]
+		n, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			// Too big to say as an ordinal, read it digit by digit
+			return digitWords(digits)
+		}
+		return ordinalWords(n)
+	})
+
+	var spoken strings.Builder
+	last := 0
+	for _, span := range numberRegex.FindAllStringIndex(text, -1) {
+		start, end := span[0], span[1]
+		// Part of a word, like v2 or H2O
+		if start > 0 && isWordRune(lastRune(text[:start])) {
+			continue
+		}
+		prefix := text[last:start]
+		if strings.HasSuffix(prefix, "-") && (start == 1 || !isWordRune(lastRune(text[:start-1]))) {
+			prefix = prefix[:len(prefix)-1] + "minus "
+		}
+		spoken.WriteString(prefix)
+		spoken.WriteString(readNumber(text[start:end]))
+		last = end
+	}
+	spoken.WriteString(text[last:])
+	return spoken.String()
+}
+
+// readNumber reads one run of digits, commas and periods
+func readNumber(number string) string {
+	switch {
+	case groupedRegex.MatchString(number):
+		return readNumber(strings.ReplaceAll(number, ",", ""))
+	case plainRegex.MatchString(number):
+		whole, fraction, _ := strings.Cut(number, ".")
+		var spoken string
+		if n, err := strconv.ParseInt(whole, 10, 64); err == nil && len(whole) <= 9 && (whole == "0" || whole[0] != '0') {
+			spoken = numberWords(n)
+		} else {
+			// Phone numbers, codes and such
+			spoken = digitWords(whole)
+		}
+		if fraction != "" {
+			spoken += " point " + digitWords(fraction)
+		}
+		return spoken
+	case strings.Contains(number, ","):
+		// A list like 1,2,3
+		return readParts(number, ",", ", ")
+	default:
+		// A version like 1.2.3
+		return readParts(number, ".", " point ")
+	}
+}
+
+// readParts reads each part of number between seps, skipping empty ones as in 1..10
+func readParts(number, sep, join string) string {
+	var spoken []string
+	for _, part := range strings.Split(number, sep) {
+		if part != "" {
+			spoken = append(spoken, readNumber(part))
+		}
+	}
+	return strings.Join(spoken, join)
+}
+
+var (
+	ones = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine",
+		"ten", "eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen", "seventeen", "eighteen", "nineteen"}
+	tens          = []string{"", "", "twenty", "thirty", "forty", "fifty", "sixty", "seventy", "eighty", "ninety"}
+	scaleNames    = []string{"", "thousand", "million", "billion", "trillion", "quadrillion", "quintillion"}
+	ordinalEnding = map[string]string{"one": "first", "two": "second", "three": "third", "five": "fifth",
+		"eight": "eighth", "nine": "ninth", "twelve": "twelfth"}
+)
+
+// numberWords writes n out in words, e.g. 1250 is one thousand two hundred fifty
+func numberWords(n int64) string {
+	if n < 0 {
+		return "minus " + numberWords(-n)
+	}
+	if n < 20 {
+		return ones[n]
+	}
+	if n < 100 {
+		if n%10 == 0 {
+			return tens[n/10]
+		}
+		return tens[n/10] + "-" + ones[n%10]
+	}
+	if n < 1000 {
+		if n%100 == 0 {
+			return ones[n/100] + " hundred"
+		}
+		return ones[n/100] + " hundred " + numberWords(n%100)
+	}
+	var groups []string
+	for scale := 0; n > 0; scale++ {
+		if group := n % 1000; group > 0 {
+			words := numberWords(group)
+			if scaleNames[scale] != "" {
+				words += " " + scaleNames[scale]
+			}
+			groups = append([]string{words}, groups...)
+		}
+		n /= 1000
+	}
+	return strings.Join(groups, " ")
+}
+
+// ordinalWords writes n out as an ordinal, e.g. 21 is twenty-first
+func ordinalWords(n int64) string {
+	words := numberWords(n)
+	cut := strings.LastIndexAny(words, " -") + 1
+	last := words[cut:]
+	if ending, ok := ordinalEnding[last]; ok {
+		return words[:cut] + ending
+	}
+	if strings.HasSuffix(last, "y") {
+		return words[:cut] + strings.TrimSuffix(last, "y") + "ieth"
+	}
+	return words + "th"
+}
+
+// yearWords reads a year the way people say it, e.g. 1999 is nineteen ninety-nine and 2024 twenty twenty-four
+func yearWords(year string) string {
+	n, err := strconv.ParseInt(year, 10, 64)
+	if err != nil || n < 1100 || n > 2099 || (n >= 2000 && n < 2010) {
+		return readNumber(year)
+	}
+	century, rest := n/100, n%100
+	switch {
+	case rest == 0:
+		return numberWords(century) + " hundred"
+	case rest < 10:
+		return numberWords(century) + " oh " + numberWords(rest)
+	default:
+		return numberWords(century) + " " + numberWords(rest)
+	}
+}
+
+func digitWords(digits string) string {
+	words := make([]string, 0, len(digits))
+	for _, digit := range digits {
+		words = append(words, ones[digit-'0'])
+	}
+	return strings.Join(words, " ")
+}
+
+func lastRune(text string) rune {
+	runes := []rune(text)
+	if len(runes) == 0 {
+		return 0
+	}
+	return runes[len(runes)-1]
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
@@ -0,0 +1,37 @@
+package utils
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		// Empty parts used to send readNumber into endless recursion
+		{"1..10", "one point ten"},
+		{"1,,2", "one, two"},
+		{"Count `1..10` out loud.", "Count one point ten out loud."},
+		{"In 1999 we met.", "In nineteen ninety-nine we met."},
+		{"Since 2001, things changed.", "Since two thousand one, things changed."},
+		{"Call 555-1234.", "Call five five five, one two three four."},
+		{"Call 555-123-4567.", "Call five five five, one two three, four five six seven."},
+		{"Call (555) 123-4567 now.", "Call five five five, one two three, four five six seven now."},
+		{"On 2024-03-15.", "On March fifteenth, twenty twenty-four."},
+		{"It costs $1.50.", "It costs one dollar and fifty cents."},
+		{"Meet at 9:05 pm.", "Meet at nine oh five P M."},
+		{"Run 5 km.", "Run five kilometers."},
+		{"We have 1,250 users.", "We have one thousand two hundred fifty users."},
+		{"Pi is 3.14.", "Pi is three point one four."},
+		{"Version 1.2.3 is out.", "Version one point two point three is out."},
+		{"Numbers 1,2,3.", "Numbers one, two, three."},
+		{"It is -4 degrees.", "It is minus four degrees."},
+		{"The 21st time.", "The twenty-first time."},
+		{"99999999999999999999th", "nine nine nine nine nine nine nine nine nine nine nine nine nine nine nine nine nine nine nine nine"},
+		{"The **API** works.", "The A P I works."},
+		{"```go\nfmt.Println(1)\n```\nDone.", "Here's some go code. Done."},
+	}
+	for _, tt := range tests {
+		if got := NewNormalizer([]string{"API"}).Normalize(tt.text); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Persona is who the bot is in a conversation: what it's told to be, which model answers and how it sounds.
+// Empty fields, and a nil Temperature, keep the server's defaults.
+type Persona struct {
+	ID           string   `json:"id"`
+	SystemPrompt string   `json:"systemPrompt,omitempty"`
+	Model        string   `json:"model,omitempty"`       // LLM model
+	Temperature  *float64 `json:"temperature,omitempty"` // LLM sampling temperature
+	Voice        string   `json:"voice,omitempty"`       // TTS voice, e.g. aura-asteria-en
+	STTLanguage  string   `json:"sttLanguage,omitempty"` // language the user speaks, e.g. fr
+}
+
+// Validate checks a persona before it's stored
+func (p Persona) Validate() error {
+	if p.ID == "" {
+		return errors.New("id is required")
+	}
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return errors.New("temperature must be between 0 and 2")
+	}
+	return nil
+}
+
+// SavePersona adds a persona, or replaces the one with the same ID
+func SavePersona(p Persona) error {
+	_, err := DB.Exec(
+		"INSERT OR REPLACE INTO personas (id, system_prompt, model, temperature, voice, stt_language) VALUES (?, ?, ?, ?, ?, ?)",
+		p.ID, p.SystemPrompt, p.Model, p.Temperature, p.Voice, p.STTLanguage,
+	)
+	return err
+}
+
+// GetPersona returns the persona with the given ID. The error is sql.ErrNoRows if there's none.
+func GetPersona(id string) (Persona, error) {
+	return scanPersona(DB.QueryRow(
+		"SELECT id, system_prompt, model, temperature, voice, stt_language FROM personas WHERE id = ?", id,
+	))
+}
+
+// GetPersonas returns every persona, sorted by ID
+func GetPersonas() ([]Persona, error) {
+	rows, err := DB.Query("SELECT id, system_prompt, model, temperature, voice, stt_language FROM personas ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	personas := []Persona{}
+	for rows.Next() {
+		p, err := scanPersona(rows)
+		if err != nil {
+			return nil, err
+		}
+		personas = append(personas, p)
+	}
+	return personas, rows.Err()
+}
+
+// DeletePersona removes a persona, ok is false if there was none.
+// Conversations bound to it go back to the server's defaults.
+func DeletePersona(id string) (ok bool, err error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("DELETE FROM personas WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE conversations SET persona_id = NULL WHERE persona_id = ?", id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// BindPersona makes every later turn of the conversation use the persona
+func BindPersona(conversationID, personaID string) error {
+	_, err := DB.Exec(`
+		INSERT INTO conversations (conversation_id, persona_id) VALUES (?, ?)
+		ON CONFLICT (conversation_id) DO UPDATE SET persona_id = excluded.persona_id`,
+		conversationID, personaID,
+	)
+	return err
+}
+
+// GetConversationPersona returns the persona the conversation is bound to, nil if it isn't bound to any
+func GetConversationPersona(conversationID string) (*Persona, error) {
+	p, err := scanPersona(DB.QueryRow(`
+		SELECT p.id, p.system_prompt, p.model, p.temperature, p.voice, p.stt_language
+		FROM conversations c JOIN personas p ON p.id = c.persona_id
+		WHERE c.conversation_id = ?`, conversationID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPersona(row scanner) (Persona, error) {
+	var p Persona
+	var systemPrompt, model, voice, sttLanguage sql.NullString
+	var temperature sql.NullFloat64
+	err := row.Scan(&p.ID, &systemPrompt, &model, &temperature, &voice, &sttLanguage)
+	p.SystemPrompt, p.Model, p.Voice, p.STTLanguage = systemPrompt.String, model.String, voice.String, sttLanguage.String
+	if temperature.Valid {
+		p.Temperature = &temperature.Float64
+	}
+	return p, err
+}
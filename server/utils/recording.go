@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// A recording past this size stops growing, that's well over an hour of webm/opus
+const maxRecordingBytes = 64 << 20
+
+// Recorder saves the raw audio of user messages to disk, for auditing transcripts
+// and building evaluation datasets. A nil Recorder records nothing.
+type Recorder struct {
+	Dir string
+}
+
+// Recording collects the audio of one user message as it streams in.
+// It's written to disk once the message has its index.
+// Every method is a no-op on a nil Recording, which is what a nil Recorder hands out.
+type Recording struct {
+	dir        string
+	encoding   string // raw encoding of the audio, empty for audio in a container
+	sampleRate int
+
+	mu        sync.Mutex
+	audio     bytes.Buffer
+	truncated bool
+}
+
+// Start begins a recording. encoding and sampleRate describe raw audio, and are empty for a container like webm.
+// header is written first, e.g. the container header from the start of a stream that outlives the message.
+func (r *Recorder) Start(encoding string, sampleRate int, header []byte) *Recording {
+	if r == nil {
+		return nil
+	}
+	recording := &Recording{dir: r.Dir, encoding: encoding, sampleRate: sampleRate}
+	if encoding == "" {
+		recording.Write(header)
+	}
+	return recording
+}
+
+// Write adds a chunk of audio to the recording
+func (r *Recording) Write(audio []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.audio.Len()+len(audio) > maxRecordingBytes {
+		if !r.truncated {
+			log.Printf("Recording is over %d bytes, dropping the rest", maxRecordingBytes)
+			r.truncated = true
+		}
+		return
+	}
+	r.audio.Write(audio)
+}
+
+// Anything else in a conversation ID is replaced so it can't escape the recordings directory
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// Save writes the recording to <dir>/<conversation>/<message index>.<ext> and returns its path.
+// 16-bit PCM is saved as WAV, anything else as it came in.
+// An empty recording isn't saved and gets an empty path.
+func (r *Recording) Save(conversationID string, messageIndex int) (string, error) {
+	if r == nil {
+		return "", nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.audio.Len() == 0 {
+		return "", nil
+	}
+
+	dir := filepath.Join(r.dir, unsafePathChars.ReplaceAllString(conversationID, "_"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	data := r.audio.Bytes()
+	ext := r.extension(data)
+	if r.encoding == "linear16" {
+		data = append(WavHeader(r.sampleRate, 1, 16, len(data)), data...)
+		ext = "wav"
+	}
+	path := filepath.Join(dir, strconv.Itoa(messageIndex)+"."+ext)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// extension guesses the file extension from the container's magic number
+func (r *Recording) extension(data []byte) string {
+	if r.encoding != "" {
+		return r.encoding
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "webm"
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return "ogg"
+	case bytes.HasPrefix(data, []byte("RIFF")):
+		return "wav"
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return "flac"
+	case len(data) > 8 && bytes.Equal(data[4:8], []byte("ftyp")):
+		return "mp4"
+	default:
+		return "bin"
+	}
+}
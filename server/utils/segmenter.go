@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Segmenter cuts the LLM's streamed reply into chunks for TTS, normally one sentence each.
+// Push the text as it streams in, then Flush once the reply is over.
+//
+// A sentence ends at . ! ? … or a CJK terminator, followed by any closing quotes, brackets or
+// markdown emphasis, then whitespace. A new line always ends a chunk, which covers list items,
+// headings and code blocks. Periods don't end a sentence in decimals, URLs or e.g. (no space after),
+// after titles like Dr., initials or list numbers, or when the next word is lowercase, as after etc.
+type Segmenter struct {
+	// Chunks shorter than MinLength characters are held back and sent together with the next sentence
+	MinLength int
+	// A sentence longer than MaxLength characters is cut at its last clause break, or word, before that.
+	// Zero means no limit.
+	MaxLength int
+	// EagerFirst sends the first chunk of the reply at its first clause break, e.g. a comma,
+	// so the user hears something as soon as possible. MinLength doesn't apply to it.
+	EagerFirst bool
+
+	buffer  []rune
+	emitted int // chunks handed out so far
+}
+
+// The first clause needs a few words to be worth its own TTS request
+const minEagerWords = 3
+
+// Titles and such that end with a period but don't end the sentence
+var abbreviations = map[string]bool{
+	"mr": true, "mrs": true, "ms": true, "dr": true, "prof": true, "st": true, "jr": true, "sr": true,
+	"mt": true, "vs": true, "gen": true, "col": true, "lt": true, "sgt": true, "capt": true, "rev": true,
+	"hon": true, "fig": true, "approx": true, "dept": true, "est": true, "inc": true, "ltd": true, "co": true,
+}
+
+// What can follow a sentence's final punctuation and still belong to it
+const closers = "\"')]}*_`”’»」』）"
+
+func NewSegmenter(minLength, maxLength int, eagerFirst bool) *Segmenter {
+	return &Segmenter{MinLength: minLength, MaxLength: maxLength, EagerFirst: eagerFirst}
+}
+
+// Push adds the next piece of the reply and returns the chunks it completed, if any
+func (s *Segmenter) Push(text string) []string {
+	s.buffer = append(s.buffer, []rune(text)...)
+	return s.cut(false)
+}
+
+// Flush returns whatever is left once the reply is over
+func (s *Segmenter) Flush() []string {
+	chunks := s.cut(true)
+	if rest := strings.TrimSpace(string(s.buffer)); rest != "" {
+		chunks = append(chunks, rest)
+		s.emitted++
+	}
+	s.buffer = nil
+	return chunks
+}
+
+// cut takes every complete chunk off the front of the buffer.
+// Unless final, a break that depends on text that hasn't arrived yet waits for it.
+func (s *Segmenter) cut(final bool) []string {
+	var chunks []string
+	for {
+		end := s.nextBreak(final)
+		if end < 0 && s.MaxLength > 0 && len(s.buffer) > s.MaxLength {
+			end = s.fallbackBreak()
+		}
+		if end < 0 {
+			return chunks
+		}
+		chunk := strings.TrimSpace(string(s.buffer[:end]))
+		s.buffer = s.buffer[end:]
+		if chunk != "" {
+			chunks = append(chunks, chunk)
+			s.emitted++
+		}
+	}
+}
+
+// nextBreak finds where the next chunk ends, -1 if it isn't complete yet
+func (s *Segmenter) nextBreak(final bool) int {
+	eager := s.EagerFirst && s.emitted == 0
+	for i := range s.buffer {
+		end, decided := sentenceEnd(s.buffer, i, final)
+		if !decided {
+			return -1
+		}
+		if end < 0 && eager {
+			end = clauseEnd(s.buffer, i)
+			if end > 0 && len(strings.Fields(string(s.buffer[:end]))) < minEagerWords {
+				end = -1
+			}
+		}
+		if end < 0 {
+			continue
+		}
+		if s.buffer[i] == '\n' || eager || len([]rune(strings.TrimSpace(string(s.buffer[:end])))) >= s.MinLength {
+			return end
+		}
+	}
+	return -1
+}
+
+// fallbackBreak is where to cut a sentence that's grown past MaxLength:
+// after its last clause break, else before its last word, else right at the limit
+func (s *Segmenter) fallbackBreak() int {
+	limit := s.buffer[:s.MaxLength]
+	for i := len(limit) - 1; i > 0; i-- {
+		if end := clauseEnd(limit, i); end > 0 {
+			return end
+		}
+	}
+	for i := len(limit) - 1; i > 0; i-- {
+		if unicode.IsSpace(limit[i]) {
+			return i
+		}
+	}
+	return s.MaxLength
+}
+
+// sentenceEnd checks whether a sentence ends with the rune at i, and returns the index right after it.
+// end is -1 if it doesn't. decided is false if that depends on text that hasn't arrived yet.
+func sentenceEnd(text []rune, i int, final bool) (end int, decided bool) {
+	r := text[i]
+	switch {
+	case r == '\n':
+		return i + 1, true
+	case strings.ContainsRune("。！？", r):
+		j := skipCloser(text, i+1)
+		if j == len(text) && !final {
+			return -1, false
+		}
+		return j, true
+	case !strings.ContainsRune(".!?…", r):
+		return -1, true
+	}
+	// Only the last of ?! or ... counts
+	if i+1 < len(text) && strings.ContainsRune(".!?…", text[i+1]) {
+		return -1, true
+	}
+	start := i
+	for start > 0 && strings.ContainsRune(".!?…", text[start-1]) {
+		start--
+	}
+	j := skipCloser(text, i+1)
+	if j == len(text) {
+		return j, final
+	}
+	if !unicode.IsSpace(text[j]) {
+		// 3.14, example.com, e.g.,
+		return -1, true
+	}
+	if r != '.' && r != '…' {
+		return j, true
+	}
+
+	// A lowercase word after a period or an ellipsis carries the sentence on
+	k := j
+	for k < len(text) && unicode.IsSpace(text[k]) {
+		if text[k] == '\n' {
+			return j, true
+		}
+		k++
+	}
+	if k == len(text) {
+		return j, final
+	}
+	if unicode.IsLower(text[k]) {
+		return -1, true
+	}
+	if start < i || r == '…' {
+		return j, true
+	}
+
+	// A single period after a title, an initial or a list number
+	wordStart := start
+	for wordStart > 0 && !unicode.IsSpace(text[wordStart-1]) {
+		wordStart--
+	}
+	word := strings.TrimLeft(string(text[wordStart:start]), "\"'([*_“‘")
+	if abbreviations[strings.ToLower(word)] {
+		return -1, true
+	}
+	if len([]rune(word)) == 1 && unicode.IsUpper([]rune(word)[0]) {
+		return -1, true
+	}
+	if word != "" && strings.Trim(word, "0123456789") == "" && atLineStart(text, wordStart) {
+		return -1, true
+	}
+	return j, true
+}
+
+// clauseEnd checks whether a clause ends with the rune at i, e.g. a comma followed by a space,
+// and returns the index right after it, or -1
+func clauseEnd(text []rune, i int) int {
+	r := text[i]
+	if strings.ContainsRune("，、；：", r) {
+		return i + 1
+	}
+	if !strings.ContainsRune(",;:—–", r) || i+1 >= len(text) || !unicode.IsSpace(text[i+1]) {
+		return -1
+	}
+	return i + 1
+}
+
+// skipCloser steps over quotes, brackets and markdown that close a sentence
+func skipCloser(text []rune, i int) int {
+	for i < len(text) && strings.ContainsRune(closers, text[i]) {
+		i++
+	}
+	return i
+}
+
+func atLineStart(text []rune, i int) bool {
+	for i > 0 && (text[i-1] == ' ' || text[i-1] == '\t') {
+		i--
+	}
+	return i == 0 || text[i-1] == '\n'
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+// segment streams text through a segmenter step runes at a time, the way LLM deltas arrive
+func segment(s *Segmenter, text string, step int) []string {
+	runes := []rune(text)
+	var chunks []string
+	for i := 0; i < len(runes); i += step {
+		chunks = append(chunks, s.Push(string(runes[i:min(i+step, len(runes))]))...)
+	}
+	return append(chunks, s.Flush()...)
+}
+
+func TestSegmenter(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max int
+		eager    bool
+		text     string
+		want     []string
+	}{
+		{"sentences", 0, 0, false, "Hello there. How are you? Fine!", []string{"Hello there.", "How are you?", "Fine!"}},
+		{"title", 0, 0, false, "I saw Dr. Smith today. He was fine.", []string{"I saw Dr. Smith today.", "He was fine."}},
+		{"e.g.", 0, 0, false, "Bring fruit, e.g. apples. Then go.", []string{"Bring fruit, e.g. apples.", "Then go."}},
+		{"initials", 0, 0, false, "He moved to the U.S. last year. It was hard.", []string{"He moved to the U.S. last year.", "It was hard."}},
+		{"decimal", 0, 0, false, "Pi is 3.14 or so. Roughly.", []string{"Pi is 3.14 or so.", "Roughly."}},
+		{"url", 0, 0, false, "See example.com/docs for more. Thanks.", []string{"See example.com/docs for more.", "Thanks."}},
+		{"ellipsis runs on", 0, 0, false, "Well... maybe not. Okay.", []string{"Well... maybe not.", "Okay."}},
+		{"ellipsis ends", 0, 0, false, "I wonder… Then again, no.", []string{"I wonder…", "Then again, no."}},
+		{"quotes", 0, 0, false, `She said "Stop." Then she left.`, []string{`She said "Stop."`, "Then she left."}},
+		{"list items", 0, 0, false, "Steps:\n1. Open it.\n2. Close it.", []string{"Steps:", "1. Open it.", "2. Close it."}},
+		{"markdown", 0, 0, false, "This is **really good.** Next one.", []string{"This is **really good.**", "Next one."}},
+		{"heading", 0, 0, false, "# Title\nSome text here.", []string{"# Title", "Some text here."}},
+		{"cjk", 0, 0, false, "你好。今天天气很好！", []string{"你好。", "今天天气很好！"}},
+		{"min length", 20, 0, false, "Yes. I agree with that completely. Ok.", []string{"Yes. I agree with that completely.", "Ok."}},
+		{"max length clause", 0, 40, false, "This sentence is rather long, and it keeps going for a while.", []string{"This sentence is rather long,", "and it keeps going for a while."}},
+		{"max length word", 0, 20, false, "Onetwo three four five six seven eight.", []string{"Onetwo three four", "five six seven", "eight."}},
+		{"eager first", 0, 0, true, "Well, I think that is right, mostly. And more, again.", []string{"Well, I think that is right,", "mostly.", "And more, again."}},
+		{"eager first needs words", 0, 0, true, "Hi, there. Bye.", []string{"Hi, there.", "Bye."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, step := range []int{1, 3, 1000} {
+				got := segment(NewSegmenter(tt.min, tt.max, tt.eager), tt.text, step)
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("step %d: got %q, want %q", step, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"encoding/binary"
+)
+
+// WavHeader builds the 44 byte header of a PCM WAV file holding dataLen bytes of samples
+func WavHeader(sampleRate, channels, bitsPerSample, dataLen int) []byte {
+	header := make([]byte, 44)
+	byteRate := sampleRate * channels * bitsPerSample / 8
+	blockAlign := channels * bitsPerSample / 8
+
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(36+dataLen))
+	copy(header[8:12], "WAVE")
+	copy(header[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16) // size of the fmt chunk
+	binary.LittleEndian.PutUint16(header[20:22], 1)  // PCM
+	binary.LittleEndian.PutUint16(header[22:24], uint16(channels))
+	binary.LittleEndian.PutUint32(header[24:28], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(byteRate))
+	binary.LittleEndian.PutUint16(header[32:34], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:36], uint16(bitsPerSample))
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], uint32(dataLen))
+	return header
+}
+
+// wavData finds the samples of a WAV file, i.e. the payload of its data chunk.
+// Returns -1 if file isn't a WAV file it can read.
+func wavData(file []byte) (start, end int) {
+	if len(file) < 12 || string(file[0:4]) != "RIFF" || string(file[8:12]) != "WAVE" {
+		return -1, -1
+	}
+	pos := 12
+	for pos+8 <= len(file) {
+		id := string(file[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(file[pos+4 : pos+8]))
+		pos += 8
+		if id == "data" {
+			// Engines writing to a pipe can't know the size up front and leave it at the maximum
+			if size > len(file)-pos {
+				size = len(file) - pos
+			}
+			return pos, pos + size
+		}
+		pos += size + size%2
+	}
+	return -1, -1
+}
+
+// JoinWav merges WAV files of the same format into one, e.g. the sentences of a reply.
+// The first file's header is kept with its sizes fixed up.
+// ok is false if one of the files isn't a WAV file it can read.
+func JoinWav(files [][]byte) (joined []byte, ok bool) {
+	if len(files) == 0 {
+		return nil, false
+	}
+	start, end := wavData(files[0])
+	if start < 0 {
+		return nil, false
+	}
+	joined = append(joined, files[0][:end]...)
+	for _, file := range files[1:] {
+		start, end := wavData(file)
+		if start < 0 {
+			return nil, false
+		}
+		joined = append(joined, file[start:end]...)
+	}
+	dataLen := len(joined) - start
+	binary.LittleEndian.PutUint32(joined[4:8], uint32(len(joined)-8))
+	binary.LittleEndian.PutUint32(joined[start-4:start], uint32(dataLen))
+	return joined, true
+}
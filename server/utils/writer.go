@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"github.com/gorilla/websocket"
 	"log"
 )
@@ -20,8 +21,19 @@ type WebSocketPacket struct {
 }
 
 // Helper function to coordinate client-bound data that gets written to the websocket
-func WriteToWebsocket(writeChan <-chan WebSocketPacket, clientConn *websocket.Conn) {
-	for packet := range writeChan {
+// Runs until writeChan is closed or ctx is cancelled.
+func WriteToWebsocket(ctx context.Context, writeChan <-chan WebSocketPacket, clientConn *websocket.Conn) {
+	for {
+		var packet WebSocketPacket
+		select {
+		case <-ctx.Done():
+			return
+		case p, ok := <-writeChan:
+			if !ok {
+				return
+			}
+			packet = p
+		}
 		switch packet.Type {
 		case TextMessage:
 			if err := clientConn.WriteMessage(websocket.TextMessage, packet.Data); err != nil {